@@ -3,16 +3,33 @@ package itunes
 import "net"
 import "encoding/binary"
 import "bytes"
-import "log"
+import "log/slog"
+import "fmt"
+import "os"
 import "io"
 import "errors"
 import "strconv"
-import "runtime/debug"
+import "sync"
+import "sync/atomic"
+import "context"
+import "time"
 
 type AfcConn struct {
 	net.Conn
 	packetnum uint64
 	exit      chan struct{}
+	l         *Lockdown
+	log       *slog.Logger
+	// mu is held for each request so Close can wait for the one in flight
+	mu      sync.Mutex
+	closing int32
+	// limit is this connection's own, shared is shared with other
+	// connections, see WithRateLimit and WithBandwidth
+	limit    *RateLimiter
+	shared   *RateLimiter
+	priority int32
+	ctx      context.Context
+	cancel   context.CancelFunc
 }
 
 func StartAFC(l *Lockdown) (*AfcConn, error) {
@@ -20,7 +37,35 @@ func StartAFC(l *Lockdown) (*AfcConn, error) {
 	if err != nil {
 		return nil, err
 	}
-	return &AfcConn{Conn: c, exit: l.exit}, nil
+	afc := &AfcConn{Conn: c, exit: l.exit, l: l, log: l.serviceLog("com.apple.afc")}
+	if l.afcRate > 0 {
+		afc.limit = NewRateLimiter(l.afcRate, afcChunk)
+	}
+	afc.shared = l.bandwidth
+	afc.priority = int32(l.priority)
+	afc.ctx, afc.cancel = context.WithCancel(context.Background())
+	return afc, nil
+}
+
+// SetPriority changes the priority of this connection's transfers on the
+// shared RateLimiter, e.g. to let a user request overtake a background sync
+func (afc *AfcConn) SetPriority(p Priority) {
+	atomic.StoreInt32(&afc.priority, int32(p))
+}
+
+// throttle waits for the rate limits before n bytes are read or written
+func (afc *AfcConn) throttle(n int) error {
+	if afc.limit == nil && afc.shared == nil {
+		return nil
+	}
+	p := Priority(atomic.LoadInt32(&afc.priority))
+	if err := afc.limit.Wait(afc.ctx, p, n); err != nil {
+		return ErrSessionClosed
+	}
+	if err := afc.shared.Wait(afc.ctx, p, n); err != nil {
+		return ErrSessionClosed
+	}
+	return nil
 }
 
 type AFCPacket struct {
@@ -30,12 +75,46 @@ type AFCPacket struct {
 	payload   []byte
 }
 
+// lost handles a failed read or write by closing the service connection.
+// The session may be shared, see SessionPool, so it is left to the heartbeat
+// to end it if the link to the device is gone.
+func (afc *AfcConn) lost() error {
+	select {
+	case <-afc.exit:
+		afc.log.Debug("AFC SendPacket: Graceful Shutdown after write")
+		return ErrSessionClosed
+	default:
+	}
+	if afc.isClosing() {
+		return ErrSessionClosed
+	}
+	afc.log.Warn("AFC SendPacket: Connection Lost")
+	afc.l.dumpCaptureOnError()
+	atomic.StoreInt32(&afc.closing, 1)
+	afc.Conn.Close()
+	return ErrSessionClosed
+}
+
 func (afc *AfcConn) SendPacket(op uint64, vheader []byte, payload []byte) (*AFCPacket, error) {
+	live := !afc.isClosing() && !afc.l.IsGracefullyShuttingdown()
+	start := time.Now()
+	res, err := afc.sendPacket(op, vheader, payload)
+	if live {
+		afc.measure(op, time.Since(start), 40+len(vheader)+len(payload), res, err)
+	}
+	return res, err
+}
+
+func (afc *AfcConn) sendPacket(op uint64, vheader []byte, payload []byte) (*AFCPacket, error) {
+	afc.mu.Lock()
+	defer afc.mu.Unlock()
+	if afc.isClosing() {
+		return nil, ErrSessionClosed
+	}
 	select {
 	case <-afc.exit:
-		log.Println("AFC SendPacket: Graceful Shutdown")
-		debug.PrintStack()
-		return nil, errors.New("Shutdown")
+		afc.log.Debug("AFC SendPacket: Graceful Shutdown")
+		return nil, ErrSessionClosed
 	default:
 	}
 	var fheader [40]byte
@@ -47,33 +126,27 @@ func (afc *AfcConn) SendPacket(op uint64, vheader []byte, payload []byte) (*AFCP
 
 	n, err := afc.Write(fheader[:])
 	if err != nil || n != 40 {
-		log.Println("AFC: Write FHeader ", n, err)
+		afc.log.Debug("AFC: Write FHeader", "n", n, "err", err)
+		return nil, afc.lost()
 	}
 	n, err = afc.Write(vheader)
 	if err != nil || n != len(vheader) {
-		log.Println("AFC: Write VHeader ", n, err)
-		panic("FATAL LOG")
+		afc.log.Debug("AFC: Write VHeader", "n", n, "err", err)
+		return nil, afc.lost()
 	}
 	n, err = afc.Write(payload)
 	if err != nil || n != len(payload) {
-		log.Println("AFC: Write Payload ", n, err)
-		panic("FATAL LOG")
+		afc.log.Debug("AFC: Write Payload", "n", n, "err", err)
+		return nil, afc.lost()
 	}
 	var rfheader [40]byte
 	n, err = io.ReadFull(afc, rfheader[:])
 	if err != nil || n != 40 {
-		log.Println("AFC: Read FHeader ", n, err)
-		select {
-		case <-afc.exit:
-			log.Println("AFC SendPacket: Graceful Shutdown after write")
-		default:
-			log.Println("AFC SendPacket: NON Graceful Shutdown")
-			close(afc.exit)
-			return nil, errors.New("Shutdown")
-		}
+		afc.log.Debug("AFC: Read FHeader", "n", n, "err", err)
+		return nil, afc.lost()
 	}
 	if binary.BigEndian.Uint64(rfheader[0:]) != 0x434641364c504141 {
-		log.Println("AFC: FHeader != CFA6LPAA")
+		afc.log.Error("AFC: FHeader != CFA6LPAA")
 		panic("FATAL LOG")
 	}
 
@@ -81,8 +154,8 @@ func (afc *AfcConn) SendPacket(op uint64, vheader []byte, payload []byte) (*AFCP
 	data := make([]byte, toread)
 	n, err = io.ReadFull(afc, data)
 	if err != nil || uint64(n) != toread {
-		log.Println("AFC: Read ", toread, n, err)
-		panic("FATAL LOG")
+		afc.log.Debug("AFC: Read", "length", toread, "n", n, "err", err)
+		return nil, afc.lost()
 	}
 
 	split := binary.LittleEndian.Uint64(rfheader[16:]) - 40
@@ -96,16 +169,16 @@ func (afc *AfcConn) SendPacket(op uint64, vheader []byte, payload []byte) (*AFCP
 
 	switch res.op {
 	case 0:
-		log.Println("AFC: SendPacket: Unexpected Response", res)
+		afc.log.Error("AFC: SendPacket: Unexpected Response", "response", res)
 		panic("FATAL LOG")
 	case 1, 14: //STATUS
 		if len(res.vheader) != 8 || len(res.payload) != 0 {
-			log.Println("AFC: SendPacket: Unexpected Response", res)
+			afc.log.Error("AFC: SendPacket: Unexpected Response", "response", res)
 			panic("FATAL LOG")
 		}
 	case 2: //Data
 		if len(res.vheader) != 0 {
-			log.Println("AFC: SendPacket: Unexpected Data Response", res)
+			afc.log.Error("AFC: SendPacket: Unexpected Data Response", "response", res)
 			panic("FATAL LOG")
 		}
 	}
@@ -113,7 +186,7 @@ func (afc *AfcConn) SendPacket(op uint64, vheader []byte, payload []byte) (*AFCP
 }
 
 func (afc *AfcConn) TEST() {
-	afc.DumpFS("/")
+	afc.DumpFS(os.Stdout, "/")
 }
 
 type FileInfo struct {
@@ -139,7 +212,7 @@ func StringToIFMT(ifmt string) IFMT {
 	case "S_IFREG":
 		return S_IFREG
 	default:
-		log.Println("Unknown IFMT:", ifmt)
+		logger().Error("AFC: Unknown IFMT", "ifmt", ifmt)
 		panic("FATAL LOG")
 	}
 	return 0
@@ -153,32 +226,32 @@ func (afc *AfcConn) GetFileInfo(file string) (FileInfo, error) {
 	}
 	v := NullTermToStrings(res.payload)
 	if len(v) != 12 || v[0] != "st_size" || v[2] != "st_blocks" || v[4] != "st_nlink" || v[6] != "st_ifmt" || v[8] != "st_mtime" || v[10] != "st_birthtime" {
-		log.Println("AFC GetFileInfo: Unexpected Payload", v)
+		afc.log.Error("AFC GetFileInfo: Unexpected Payload", "payload", v)
 		return FileInfo{}, errors.New("Unexpected Payload")
 	}
 	r1, err := strconv.ParseUint(v[1], 10, 64)
 	if err != nil {
-		log.Println("AFC ParseUint Error: ", res)
+		afc.log.Error("AFC: ParseUint Error", "response", res)
 		return FileInfo{}, errors.New("ParseError")
 	}
 	r3, err := strconv.ParseUint(v[3], 10, 64)
 	if err != nil {
-		log.Println("AFC ParseUint Error: ", res)
+		afc.log.Error("AFC: ParseUint Error", "response", res)
 		return FileInfo{}, errors.New("ParseError")
 	}
 	r5, err := strconv.ParseUint(v[5], 10, 64)
 	if err != nil {
-		log.Println("AFC ParseUint Error: ", res)
+		afc.log.Error("AFC: ParseUint Error", "response", res)
 		return FileInfo{}, errors.New("ParseError")
 	}
 	r9, err := strconv.ParseUint(v[9], 10, 64)
 	if err != nil {
-		log.Println("AFC ParseUint Error: ", res)
+		afc.log.Error("AFC: ParseUint Error", "response", res)
 		return FileInfo{}, errors.New("ParseError")
 	}
 	r11, err := strconv.ParseUint(v[11], 10, 64)
 	if err != nil {
-		log.Println("AFC ParseUint Error: ", res)
+		afc.log.Error("AFC: ParseUint Error", "response", res)
 		return FileInfo{}, errors.New("ParseError")
 	}
 	return FileInfo{
@@ -191,8 +264,31 @@ func (afc *AfcConn) GetFileInfo(file string) (FileInfo, error) {
 	}, nil
 }
 
+type AfcOpenMode uint64
+
+const (
+	AFC_FOPEN_RDONLY   AfcOpenMode = 1
+	AFC_FOPEN_RW       AfcOpenMode = 2
+	AFC_FOPEN_WRONLY   AfcOpenMode = 3 // Created and truncated
+	AFC_FOPEN_WR       AfcOpenMode = 4
+	AFC_FOPEN_APPEND   AfcOpenMode = 5
+	AFC_FOPEN_RDAPPEND AfcOpenMode = 6
+)
+
+// AfcStatus is a non zero status returned by the device
+type AfcStatus uint64
+
+func (s AfcStatus) Error() string {
+	return "AFC: Status " + strconv.FormatUint(uint64(s), 10)
+}
+
 func (afc *AfcConn) FileRefOpen(file string) (uint64, error) {
-	vheader := []byte{1, 0, 0, 0, 0, 0, 0, 0}
+	return afc.FileRefOpenMode(file, AFC_FOPEN_RDONLY)
+}
+
+func (afc *AfcConn) FileRefOpenMode(file string, mode AfcOpenMode) (uint64, error) {
+	vheader := make([]byte, 8)
+	binary.LittleEndian.PutUint64(vheader, uint64(mode))
 	vheader = append(vheader, []byte(file)...)
 	vheader = append(vheader, 0)
 
@@ -201,10 +297,13 @@ func (afc *AfcConn) FileRefOpen(file string) (uint64, error) {
 		return 0, err
 	}
 
-	if res.op == 14 {
+	switch res.op {
+	case 14:
 		return binary.LittleEndian.Uint64(res.vheader), nil
+	case 1:
+		return 0, AfcStatus(binary.LittleEndian.Uint64(res.vheader))
 	}
-	log.Println("AFC: Unexpected Response", res)
+	afc.log.Error("AFC: Unexpected Response", "response", res)
 	panic("FATAL LOG")
 	return 0, errors.New("AFC Unexpected Response")
 }
@@ -214,15 +313,21 @@ func (afc *AfcConn) FileRefRead(handle uint64, length uint64) ([]byte, error) {
 	binary.LittleEndian.PutUint64(vheader[:], handle)
 	binary.LittleEndian.PutUint64(vheader[8:], length)
 
+	if err := afc.throttle(int(length)); err != nil {
+		return nil, err
+	}
 	res, err := afc.SendPacket(15, vheader, nil)
 	if err != nil {
 		return nil, err
 	}
 
-	if res.op == 2 {
+	switch res.op {
+	case 2:
 		return res.payload, nil
+	case 1:
+		return nil, AfcStatus(binary.LittleEndian.Uint64(res.vheader))
 	}
-	log.Println("AFC: Unexpected Response", res)
+	afc.log.Error("AFC: Unexpected Response", "response", res)
 	panic("FATAL LOG")
 	return nil, errors.New("AFC Unexpected Response")
 
@@ -231,8 +336,8 @@ func (afc *AfcConn) FileRefRead(handle uint64, length uint64) ([]byte, error) {
 func (afc *AfcConn) FileRefSeek(handle uint64, offset int64, whence int) error {
 	vheader := make([]byte, 24)
 	binary.LittleEndian.PutUint64(vheader[:], handle)
-	binary.LittleEndian.PutUint64(vheader[8:], uint64(offset))
 	binary.LittleEndian.PutUint64(vheader[8:], uint64(whence))
+	binary.LittleEndian.PutUint64(vheader[16:], uint64(offset))
 
 	res, err := afc.SendPacket(0x11, vheader, nil)
 	if err != nil {
@@ -240,17 +345,38 @@ func (afc *AfcConn) FileRefSeek(handle uint64, offset int64, whence int) error {
 	}
 
 	if res.op == 1 {
-		status := binary.LittleEndian.Uint64(res.vheader)
-		if status != 0 {
-			panic(status)
+		if status := binary.LittleEndian.Uint64(res.vheader); status != 0 {
+			return AfcStatus(status)
 		}
 		return nil
 	}
-	log.Println("AFC: Unexpected Response", res)
+	afc.log.Error("AFC: Unexpected Response", "response", res)
 	panic("FATAL LOG")
 	return errors.New("AFC Unexpected Response")
 }
 
+func (afc *AfcConn) FileRefWrite(handle uint64, data []byte) error {
+	vheader := make([]byte, 8)
+	binary.LittleEndian.PutUint64(vheader[:], handle)
+
+	if err := afc.throttle(len(data)); err != nil {
+		return err
+	}
+	res, err := afc.SendPacket(16, vheader, data)
+	if err != nil {
+		return err
+	}
+
+	if res.op == 1 {
+		if status := binary.LittleEndian.Uint64(res.vheader); status != 0 {
+			return AfcStatus(status)
+		}
+		return nil
+	}
+	afc.log.Error("AFC: Unexpected Response", "response", res)
+	return errors.New("AFC Unexpected Response")
+}
+
 func (afc *AfcConn) FileRefClose(handle uint64) error {
 	vheader := make([]byte, 8)
 	binary.LittleEndian.PutUint64(vheader[:], handle)
@@ -260,7 +386,7 @@ func (afc *AfcConn) FileRefClose(handle uint64) error {
 	}
 
 	if res.op != 1 && binary.LittleEndian.Uint64(res.vheader) != 0 {
-		log.Println("AFC: Unexpected Response", res)
+		afc.log.Error("AFC: Unexpected Response", "response", res)
 		panic("FATAL LOG")
 	}
 	return nil
@@ -279,12 +405,12 @@ func (afc *AfcConn) GetDirectory(dir string) ([]string, error) {
 		if status == 4 { // NOT_DIRECTORY?
 			return nil, errors.New("AFC Not directory")
 		}
-		log.Println("AFC: Unexpected Status Response", res)
+		afc.log.Error("AFC: Unexpected Status Response", "response", res)
 		panic("FATAL LOG")
 		return nil, errors.New("AFC Unexpected Response")
 	case 2:
 		if len(res.vheader) != 0 || len(res.payload) == 0 {
-			log.Println("AFC: DumpFS Payload: ", res)
+			afc.log.Error("AFC: DumpFS Payload", "response", res)
 			panic("FATAL LOG")
 			return nil, errors.New("Not sure")
 		}
@@ -292,10 +418,11 @@ func (afc *AfcConn) GetDirectory(dir string) ([]string, error) {
 	return NullTermToStrings(res.payload), nil
 }
 
-func (afc *AfcConn) DumpFS(dir string) bool {
+// DumpFS writes the size, link count and path of everything below dir to w
+func (afc *AfcConn) DumpFS(w io.Writer, dir string) error {
 	b, err := afc.GetDirectory(dir)
 	if err != nil {
-		panic(err)
+		return err
 	}
 	for _, v := range b {
 		switch v {
@@ -304,17 +431,19 @@ func (afc *AfcConn) DumpFS(dir string) bool {
 		default:
 			fi, err := afc.GetFileInfo(dir + v)
 			if err != nil {
-				panic(err)
+				return err
 			}
 			if fi.St_ifmt != S_IFDIR {
-				log.Printf("%10d %10d %s\n", fi.St_size, fi.St_nlink, dir+v)
+				fmt.Fprintf(w, "%10d %10d %s\n", fi.St_size, fi.St_nlink, dir+v)
 			} else {
-				log.Printf("%10d %10d %s\n", fi.St_size, fi.St_nlink, dir+v+"/")
-				afc.DumpFS(dir + v + "/")
+				fmt.Fprintf(w, "%10d %10d %s\n", fi.St_size, fi.St_nlink, dir+v+"/")
+				if err := afc.DumpFS(w, dir+v+"/"); err != nil {
+					return err
+				}
 			}
 		}
 	}
-	return true
+	return nil
 }
 
 func NullTermToStrings(b []byte) (s []string) {
@@ -0,0 +1,137 @@
+package itunes
+
+import "log/slog"
+import "net"
+import "sync"
+import "time"
+import "github.com/pkg/errors"
+
+// Power assertion types understood by com.apple.mobile.assertion_agent
+const (
+	AssertionWirelessSync               = "AMDPowerAssertionTypeWirelessSync"
+	AssertionPreventUserIdleSystemSleep = "PreventUserIdleSystemSleep"
+	AssertionPreventSystemSleep         = "PreventSystemSleep"
+)
+
+type assertionRequest struct {
+	CommandKey          string
+	AssertionTypeKey    string
+	AssertionNameKey    string
+	AssertionTimeoutKey int64
+}
+
+type assertionResponse struct {
+	CommandKey string
+	Error      string
+}
+
+// PowerAssertion keeps the device awake. The assertion is renewed before
+// Timeout runs out until Release is called or the session stops.
+type PowerAssertion struct {
+	Type    string
+	Name    string
+	Timeout time.Duration
+
+	mu   sync.Mutex
+	log  *slog.Logger
+	c    net.Conn
+	stop chan struct{}
+	once sync.Once
+}
+
+// PowerAssertionMinTimeout is the shortest Timeout the device accepts. The
+// assertion agent counts in whole seconds.
+const PowerAssertionMinTimeout = time.Second
+
+// CreatePowerAssertion starts com.apple.mobile.assertion_agent and creates an
+// assertion of Type. Timeout is rounded up to whole seconds, shorter than
+// PowerAssertionMinTimeout is an error.
+func (l *Lockdown) CreatePowerAssertion(Type string, Name string, Timeout time.Duration) (*PowerAssertion, error) {
+	if Timeout < PowerAssertionMinTimeout {
+		return nil, errors.Errorf("PowerAssertion: Timeout %v is shorter than %v", Timeout, PowerAssertionMinTimeout)
+	}
+	Timeout = (Timeout + time.Second - 1) / time.Second * time.Second
+	c, err := l.StartService("com.apple.mobile.assertion_agent")
+	if err != nil {
+		return nil, err
+	}
+	a := &PowerAssertion{
+		Type:    Type,
+		Name:    Name,
+		Timeout: Timeout,
+		log:     l.serviceLog("com.apple.mobile.assertion_agent"),
+		c:       c,
+		stop:    make(chan struct{}),
+	}
+	if err := a.create(); err != nil {
+		c.Close()
+		return nil, err
+	}
+	go a.renew(l.exit)
+	return a, nil
+}
+
+func (a *PowerAssertion) create() error {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	s := assertionRequest{
+		CommandKey:          "CommandCreateAssertion",
+		AssertionTypeKey:    a.Type,
+		AssertionNameKey:    a.Name,
+		AssertionTimeoutKey: int64(a.Timeout / time.Second),
+	}
+	var res assertionResponse
+	if err := sendPlist(a.c, s, &res); err != nil {
+		return errors.Wrap(err, "PowerAssertion: Unable to Create Assertion")
+	}
+	if res.Error != "" {
+		return errors.Wrap(LockdownError(res.Error), "PowerAssertion: "+a.Type)
+	}
+	return nil
+}
+
+// renew recreates the assertion at half its timeout
+func (a *PowerAssertion) renew(exit <-chan struct{}) {
+	tick := time.NewTicker(a.Timeout / 2)
+	defer tick.Stop()
+	for {
+		select {
+		case <-tick.C:
+			if err := a.create(); err != nil {
+				a.log.Warn("ASSERTION: Renew", "err", err)
+				a.Release()
+				return
+			}
+		case <-exit:
+			a.Release()
+			return
+		case <-a.stop:
+			return
+		}
+	}
+}
+
+// Release stops renewing and drops the assertion
+func (a *PowerAssertion) Release() {
+	a.once.Do(func() {
+		close(a.stop)
+		a.mu.Lock()
+		a.c.Close()
+		a.mu.Unlock()
+	})
+}
+
+type powerAssertionOption struct {
+	Type    string
+	Timeout time.Duration
+}
+
+// WithPowerAssertion makes the AfcRetryConn transfer helpers, DownloadFile,
+// DownloadFiles and PutFile, hold a power assertion of Type while they run,
+// so long transfers are not cut by the device sleeping. The assertion is
+// created again on the new connection after a reconnect.
+func WithPowerAssertion(Type string, Timeout time.Duration) Option {
+	return func(l *Lockdown) {
+		l.assertion = &powerAssertionOption{Type, Timeout}
+	}
+}
@@ -0,0 +1,335 @@
+package itunes
+
+import "net"
+import "sync"
+import "time"
+import "strings"
+import "fmt"
+import "github.com/pkg/errors"
+import "golang.org/x/net/dns/dnsmessage"
+
+// BonjourService is the service announced by devices with Wi-Fi sync enabled
+const BonjourService = "_apple-mobdev2._tcp.local."
+
+// BonjourEvent is sent when a device appears or disappears. Instance is the
+// escaped Bonjour instance name, as returned by InstanceName. Link-local
+// Addrs carry the zone they were received on. UDID is set when the device's
+// Wi-Fi MAC address matched a record in the browser's PairStore, the record
+// itself is not kept so call Store.Get when it is needed.
+type BonjourEvent struct {
+	Appeared bool
+	Instance string
+	MAC      net.HardwareAddr
+	Addrs    []net.IPAddr
+	Port     int
+	UDID     string
+}
+
+// MDNSTransport is a socket the browser queries on. Queries are sent to Group.
+// Zone is the interface link-local addresses received on Conn belong to,
+// when empty the zone of the sender's address is used.
+type MDNSTransport struct {
+	Conn  net.PacketConn
+	Group net.Addr
+	Zone  string
+}
+
+// BonjourBrowser finds devices announcing BonjourService. With no Transports
+// it listens on the IPv4 and IPv6 mDNS multicast groups, tests can instead
+// point a transport at a local responder.
+type BonjourBrowser struct {
+	Transports []MDNSTransport
+	Store      PairStore
+	Interval   time.Duration
+
+	mu        sync.Mutex
+	instances map[string]*bonjourInstance
+	hosts     map[string]*bonjourHost
+	events    chan BonjourEvent
+	stop      <-chan struct{}
+}
+
+type bonjourInstance struct {
+	target  string
+	port    int
+	expires time.Time
+	up      bool
+}
+
+type bonjourHost struct {
+	addrs   map[string]net.IPAddr
+	expires time.Time
+}
+
+var (
+	mdnsGroup4 = &net.UDPAddr{IP: net.IPv4(224, 0, 0, 251), Port: 5353}
+	mdnsGroup6 = &net.UDPAddr{IP: net.ParseIP("ff02::fb"), Port: 5353}
+)
+
+// Browse starts browsing until stop is closed, then closes the returned
+// channel and the transports
+func (b *BonjourBrowser) Browse(stop <-chan struct{}) (<-chan BonjourEvent, error) {
+	if len(b.Transports) == 0 {
+		if c, err := net.ListenMulticastUDP("udp4", nil, mdnsGroup4); err == nil {
+			b.Transports = append(b.Transports, MDNSTransport{Conn: c, Group: mdnsGroup4})
+		}
+		if c, err := net.ListenMulticastUDP("udp6", nil, mdnsGroup6); err == nil {
+			b.Transports = append(b.Transports, MDNSTransport{Conn: c, Group: mdnsGroup6})
+		}
+		if len(b.Transports) == 0 {
+			return nil, errors.New("Bonjour: Unable to Listen for mDNS")
+		}
+	}
+	if b.Interval == 0 {
+		b.Interval = 10 * time.Second
+	}
+	b.instances = make(map[string]*bonjourInstance)
+	b.hosts = make(map[string]*bonjourHost)
+	b.events = make(chan BonjourEvent, 16)
+	b.stop = stop
+
+	var wg sync.WaitGroup
+	for _, t := range b.Transports {
+		wg.Add(1)
+		go func(t MDNSTransport) {
+			defer wg.Done()
+			b.read(t)
+		}(t)
+	}
+	go func() {
+		<-stop
+		for _, t := range b.Transports {
+			t.Conn.Close()
+		}
+	}()
+	go func() {
+		tick := time.NewTicker(b.Interval)
+		defer tick.Stop()
+		for {
+			b.query(BonjourService, dnsmessage.TypePTR)
+			select {
+			case <-tick.C:
+				b.expire()
+			case <-stop:
+				wg.Wait()
+				close(b.events)
+				return
+			}
+		}
+	}()
+	return b.events, nil
+}
+
+func (b *BonjourBrowser) query(name string, types ...dnsmessage.Type) {
+	n, err := dnsmessage.NewName(name)
+	if err != nil {
+		return
+	}
+	msg := dnsmessage.Message{}
+	for _, t := range types {
+		msg.Questions = append(msg.Questions, dnsmessage.Question{Name: n, Type: t, Class: dnsmessage.ClassINET})
+	}
+	buf, err := msg.Pack()
+	if err != nil {
+		return
+	}
+	for _, t := range b.Transports {
+		if _, err := t.Conn.WriteTo(buf, t.Group); err != nil {
+			logger().Debug("BONJOUR: Query", "err", err)
+		}
+	}
+}
+
+func (b *BonjourBrowser) read(t MDNSTransport) {
+	buf := make([]byte, 9000)
+	for {
+		n, src, err := t.Conn.ReadFrom(buf)
+		if err != nil {
+			select {
+			case <-b.stop:
+			default:
+				logger().Warn("BONJOUR: Read", "err", err)
+			}
+			return
+		}
+		var msg dnsmessage.Message
+		if err := msg.Unpack(buf[:n]); err != nil || !msg.Header.Response {
+			continue
+		}
+		zone := t.Zone
+		if ua, ok := src.(*net.UDPAddr); ok && zone == "" {
+			zone = ua.Zone
+		}
+		b.handle(msg, zone)
+	}
+}
+
+// handle records the answers in msg, received on the interface zone
+func (b *BonjourBrowser) handle(msg dnsmessage.Message, zone string) {
+	now := time.Now()
+	var need []string
+	b.mu.Lock()
+	records := append(append(msg.Answers, msg.Additionals...), msg.Authorities...)
+	// Addresses first so instances in the same packet resolve immediately
+	for _, r := range records {
+		var ip net.IPAddr
+		switch body := r.Body.(type) {
+		case *dnsmessage.AResource:
+			ip.IP = net.IP(body.A[:])
+		case *dnsmessage.AAAAResource:
+			ip.IP = net.IP(body.AAAA[:])
+			if ip.IP.IsLinkLocalUnicast() {
+				ip.Zone = zone
+			}
+		default:
+			continue
+		}
+		name := strings.ToLower(r.Header.Name.String())
+		h := b.hosts[name]
+		if h == nil {
+			h = &bonjourHost{addrs: make(map[string]net.IPAddr)}
+			b.hosts[name] = h
+		}
+		if r.Header.TTL == 0 {
+			delete(h.addrs, ip.String())
+			continue
+		}
+		h.addrs[ip.String()] = ip
+		h.expires = now.Add(b.lifetime(r.Header.TTL))
+	}
+	for _, r := range records {
+		switch body := r.Body.(type) {
+		case *dnsmessage.PTRResource:
+			if !strings.EqualFold(r.Header.Name.String(), BonjourService) {
+				continue
+			}
+			name := body.PTR.String()
+			i := b.instances[name]
+			if r.Header.TTL == 0 {
+				if i != nil {
+					i.expires = now
+				}
+				continue
+			}
+			if i == nil {
+				i = &bonjourInstance{}
+				b.instances[name] = i
+				need = append(need, name)
+			}
+			i.expires = now.Add(b.lifetime(r.Header.TTL))
+		case *dnsmessage.SRVResource:
+			i := b.instances[r.Header.Name.String()]
+			if i == nil {
+				continue
+			}
+			i.target = strings.ToLower(body.Target.String())
+			i.port = int(body.Port)
+		}
+	}
+	b.mu.Unlock()
+
+	for _, name := range need {
+		b.query(name, dnsmessage.TypeSRV)
+	}
+	b.expire()
+}
+
+// lifetime is how long a record is trusted. Devices stop answering when they
+// sleep long before their TTL runs out, so records not refreshed by the last
+// three queries are dropped.
+func (b *BonjourBrowser) lifetime(TTL uint32) time.Duration {
+	d := time.Duration(TTL) * time.Second
+	if d > 3*b.Interval {
+		d = 3 * b.Interval
+	}
+	return d
+}
+
+// expire sends events for instances that resolved or timed out
+func (b *BonjourBrowser) expire() {
+	now := time.Now()
+	var events []BonjourEvent
+	var resolve []string
+	b.mu.Lock()
+	for name, i := range b.instances {
+		if !now.Before(i.expires) {
+			if i.up {
+				events = append(events, b.event(name, i, false))
+			}
+			delete(b.instances, name)
+			continue
+		}
+		if i.up {
+			continue
+		}
+		h := b.hosts[i.target]
+		if i.target == "" {
+			continue
+		}
+		if h == nil || len(h.addrs) == 0 || !now.Before(h.expires) {
+			resolve = append(resolve, i.target)
+			continue
+		}
+		i.up = true
+		events = append(events, b.event(name, i, true))
+	}
+	b.mu.Unlock()
+
+	for _, target := range resolve {
+		b.query(target, dnsmessage.TypeA, dnsmessage.TypeAAAA)
+	}
+	for _, e := range events {
+		select {
+		case b.events <- e:
+		case <-b.stop:
+			return
+		}
+	}
+}
+
+// event builds a BonjourEvent for name. b.mu must be held.
+func (b *BonjourBrowser) event(name string, i *bonjourInstance, up bool) BonjourEvent {
+	e := BonjourEvent{Appeared: up, Port: i.port}
+	label := strings.TrimSuffix(name, "."+BonjourService)
+	e.Instance = escapeLabel(label)
+	if h := b.hosts[i.target]; h != nil {
+		for _, ip := range h.addrs {
+			e.Addrs = append(e.Addrs, ip)
+		}
+	}
+	mac := label
+	if at := strings.Index(mac, "@"); at != -1 {
+		mac = mac[:at]
+	}
+	hw, err := net.ParseMAC(mac)
+	if err != nil {
+		return e
+	}
+	e.MAC = hw
+	if b.Store != nil {
+		if UDID, pair, err := b.Store.ByWiFiMACAddress(hw.String()); err == nil {
+			e.UDID = UDID
+			pair.Wipe()
+		}
+	}
+	return e
+}
+
+// escapeLabel writes a DNS label in presentation format, escaping the
+// characters dns-sd does, so "mac@fe80::..." becomes "mac\@fe80::..."
+func escapeLabel(label string) string {
+	var b strings.Builder
+	for i := 0; i < len(label); i++ {
+		c := label[i]
+		switch {
+		case strings.IndexByte(`.\@();" $`, c) != -1:
+			b.WriteByte('\\')
+			b.WriteByte(c)
+		case c < ' ' || c > '~':
+			fmt.Fprintf(&b, "\\%03d", c)
+		default:
+			b.WriteByte(c)
+		}
+	}
+	return b.String()
+}
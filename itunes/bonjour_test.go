@@ -0,0 +1,208 @@
+package itunes
+
+import "net"
+import "strings"
+import "sync"
+import "testing"
+import "time"
+import "golang.org/x/net/dns/dnsmessage"
+
+// testResponder answers the browser's queries for one device
+type testResponder struct {
+	conn    net.PacketConn
+	mac     net.HardwareAddr
+	label   string
+	host    string
+	ip      net.IP
+	ll      net.IP
+	mu      sync.Mutex
+	silent  bool
+	browser net.Addr
+}
+
+func newTestResponder(t *testing.T) *testResponder {
+	c, err := net.ListenPacket("udp4", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { c.Close() })
+	mac, _ := net.ParseMAC("aa:bb:cc:dd:ee:ff")
+	r := &testResponder{
+		conn:  c,
+		mac:   mac,
+		label: mac.String() + "@" + LinkLocalAddress(mac).String(),
+		host:  "iPhone.local.",
+		ip:    net.IPv4(127, 0, 0, 1).To4(),
+		ll:    LinkLocalAddress(mac),
+	}
+	go r.serve()
+	return r
+}
+
+func (r *testResponder) serve() {
+	buf := make([]byte, 9000)
+	for {
+		n, src, err := r.conn.ReadFrom(buf)
+		if err != nil {
+			return
+		}
+		var q dnsmessage.Message
+		if err := q.Unpack(buf[:n]); err != nil {
+			continue
+		}
+		r.mu.Lock()
+		r.browser = src
+		silent := r.silent
+		r.mu.Unlock()
+		if silent {
+			continue
+		}
+		var answers []dnsmessage.Resource
+		for _, question := range q.Questions {
+			answers = append(answers, r.answer(question, 120)...)
+		}
+		r.send(src, answers)
+	}
+}
+
+func (r *testResponder) answer(q dnsmessage.Question, TTL uint32) []dnsmessage.Resource {
+	instance := dnsmessage.MustNewName(r.label + "." + BonjourService)
+	host := dnsmessage.MustNewName(r.host)
+	header := func(name dnsmessage.Name, Type dnsmessage.Type) dnsmessage.ResourceHeader {
+		return dnsmessage.ResourceHeader{Name: name, Type: Type, Class: dnsmessage.ClassINET, TTL: TTL}
+	}
+	switch {
+	case q.Type == dnsmessage.TypePTR && strings.EqualFold(q.Name.String(), BonjourService):
+		return []dnsmessage.Resource{{
+			Header: header(q.Name, dnsmessage.TypePTR),
+			Body:   &dnsmessage.PTRResource{PTR: instance},
+		}}
+	case q.Type == dnsmessage.TypeSRV && strings.EqualFold(q.Name.String(), instance.String()):
+		return []dnsmessage.Resource{{
+			Header: header(instance, dnsmessage.TypeSRV),
+			Body:   &dnsmessage.SRVResource{Target: host, Port: 62078},
+		}}
+	case q.Type == dnsmessage.TypeA && strings.EqualFold(q.Name.String(), r.host):
+		var a dnsmessage.AResource
+		copy(a.A[:], r.ip)
+		return []dnsmessage.Resource{{Header: header(host, dnsmessage.TypeA), Body: &a}}
+	case q.Type == dnsmessage.TypeAAAA && strings.EqualFold(q.Name.String(), r.host):
+		var aaaa dnsmessage.AAAAResource
+		copy(aaaa.AAAA[:], r.ll)
+		return []dnsmessage.Resource{{Header: header(host, dnsmessage.TypeAAAA), Body: &aaaa}}
+	}
+	return nil
+}
+
+func (r *testResponder) send(to net.Addr, answers []dnsmessage.Resource) {
+	if len(answers) == 0 {
+		return
+	}
+	msg := dnsmessage.Message{Header: dnsmessage.Header{Response: true, Authoritative: true}, Answers: answers}
+	buf, err := msg.Pack()
+	if err != nil {
+		panic(err)
+	}
+	r.conn.WriteTo(buf, to)
+}
+
+// goodbye announces the instance with a TTL of zero
+func (r *testResponder) goodbye() {
+	r.mu.Lock()
+	to := r.browser
+	r.mu.Unlock()
+	q := dnsmessage.Question{Name: dnsmessage.MustNewName(BonjourService), Type: dnsmessage.TypePTR}
+	r.send(to, r.answer(q, 0))
+}
+
+func (r *testResponder) setSilent(silent bool) {
+	r.mu.Lock()
+	r.silent = silent
+	r.mu.Unlock()
+}
+
+func nextBonjourEvent(t *testing.T, events <-chan BonjourEvent) BonjourEvent {
+	t.Helper()
+	select {
+	case e, ok := <-events:
+		if !ok {
+			t.Fatal("events closed")
+		}
+		return e
+	case <-time.After(5 * time.Second):
+		t.Fatal("no event")
+	}
+	return BonjourEvent{}
+}
+
+func TestBonjourBrowser(t *testing.T) {
+	r := newTestResponder(t)
+	c, err := net.ListenPacket("udp4", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	b := &BonjourBrowser{
+		Transports: []MDNSTransport{{Conn: c, Group: r.conn.LocalAddr(), Zone: "lo"}},
+		Interval:   50 * time.Millisecond,
+	}
+	stop := make(chan struct{})
+	events, err := b.Browse(stop)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer close(stop)
+
+	instance, err := InstanceName(PairRecord{WiFiMACAddress: r.mac.String()})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	e := nextBonjourEvent(t, events)
+	if !e.Appeared || e.Instance != instance || e.MAC.String() != r.mac.String() || e.Port != 62078 {
+		t.Fatalf("appear event %+v, want instance %s", e, instance)
+	}
+	want := map[string]bool{
+		(&net.IPAddr{IP: r.ip}).String():             false,
+		(&net.IPAddr{IP: r.ll, Zone: "lo"}).String(): false,
+	}
+	for _, a := range e.Addrs {
+		want[a.String()] = true
+	}
+	for a, seen := range want {
+		if !seen {
+			t.Errorf("address %s missing from %v", a, e.Addrs)
+		}
+	}
+
+	r.goodbye()
+	if e := nextBonjourEvent(t, events); e.Appeared || e.Instance != instance {
+		t.Fatalf("goodbye event %+v", e)
+	}
+
+	// The next query finds the device again
+	if e := nextBonjourEvent(t, events); !e.Appeared {
+		t.Fatalf("reappear event %+v", e)
+	}
+
+	// Records expire after three unanswered queries
+	r.setSilent(true)
+	start := time.Now()
+	if e := nextBonjourEvent(t, events); e.Appeared || e.Instance != instance {
+		t.Fatalf("expire event %+v", e)
+	}
+	if d := time.Since(start); d < 2*b.Interval {
+		t.Errorf("expired after %v, too soon", d)
+	}
+}
+
+func TestEscapeLabel(t *testing.T) {
+	for in, want := range map[string]string{
+		"aa:bb@fe80::1": `aa:bb\@fe80::1`,
+		"a.b":           `a\.b`,
+		"a b\x01":       `a\ b\001`,
+	} {
+		if got := escapeLabel(in); got != want {
+			t.Errorf("escapeLabel(%q) = %q, want %q", in, got, want)
+		}
+	}
+}
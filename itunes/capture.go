@@ -0,0 +1,441 @@
+package itunes
+
+import "os"
+import "io"
+import "net"
+import "fmt"
+import "sort"
+import "strings"
+import "sync"
+import "sync/atomic"
+import "time"
+import "path/filepath"
+import "encoding/binary"
+import "github.com/pkg/errors"
+
+// CapturePacket is a chunk of plaintext read from or written to a lockdown
+// or service connection
+type CapturePacket struct {
+	Time     time.Time
+	Local    *net.TCPAddr
+	Remote   *net.TCPAddr
+	Outbound bool
+	Seq      uint32
+	Ack      uint32
+	Data     []byte
+}
+
+// CaptureSink receives the traffic of a Lockdown session and its services.
+// WritePacket is called concurrently from every connection of the session.
+type CaptureSink interface {
+	WritePacket(p CapturePacket) error
+	// Dump persists the capture on demand. Continuous sinks may ignore it.
+	Dump() error
+	Close() error
+}
+
+// WithCapture records the session and every service it starts to sink. When
+// dumpOnError is set sink.Dump is called if the session fails. The caller owns
+// sink and closes it when finished, one sink per device keeps captures apart.
+func WithCapture(sink CaptureSink, dumpOnError bool) Option {
+	return func(l *Lockdown) {
+		l.capture = sink
+		l.dumpOnError = dumpOnError
+	}
+}
+
+// captureNamer is a sink whose file name defaults to the device's
+type captureNamer interface {
+	defaultName(name string)
+}
+
+// nameCapture names the capture after the device when the sink's Name is
+// empty. Only the pair record is known before dialling, so the Wi-Fi MAC
+// address is used, or the HostID when there is none.
+func (l *Lockdown) nameCapture(mac string) {
+	n, ok := l.capture.(captureNamer)
+	if !ok {
+		return
+	}
+	name := mac
+	if hw, err := net.ParseMAC(mac); err == nil {
+		name = strings.ReplaceAll(hw.String(), ":", "")
+	}
+	if name == "" {
+		name = l.pair.HostID
+	}
+	n.defaultName(name)
+}
+
+// DumpCapture asks the capture sink to persist what it holds
+func (l *Lockdown) DumpCapture() error {
+	if l.capture == nil {
+		return nil
+	}
+	return l.capture.Dump()
+}
+
+func (l *Lockdown) dumpCaptureOnError() {
+	if l.capture == nil || !l.dumpOnError {
+		return
+	}
+	if err := l.capture.Dump(); err != nil {
+		l.log.Warn("LOCKDOWN: Capture Dump", "err", err)
+	}
+}
+
+var captureLocalPort uint32 = 49152
+
+// captureConn records traffic on Conn. Conn may be replaced, e.g. by a TLS
+// connection after StartSession, so the capture shows plaintext throughout.
+type captureConn struct {
+	net.Conn
+	sink   CaptureSink
+	local  *net.TCPAddr
+	remote *net.TCPAddr
+	seqOut uint32
+	seqIn  uint32
+}
+
+func wrapCapture(c net.Conn, sink CaptureSink, port int) *captureConn {
+	cc := &captureConn{Conn: c, sink: sink}
+	if sink == nil {
+		return cc
+	}
+	if a, ok := c.LocalAddr().(*net.TCPAddr); ok {
+		cc.local = a
+	} else {
+		p := int(atomic.AddUint32(&captureLocalPort, 1)%16384 + 49152)
+		cc.local = &net.TCPAddr{IP: net.IPv4(127, 0, 0, 1), Port: p}
+	}
+	if a, ok := c.RemoteAddr().(*net.TCPAddr); ok {
+		cc.remote = a
+	} else {
+		cc.remote = &net.TCPAddr{IP: net.IPv4(127, 0, 0, 2), Port: port}
+	}
+	return cc
+}
+
+func (c *captureConn) Read(b []byte) (int, error) {
+	n, err := c.Conn.Read(b)
+	if n > 0 && c.sink != nil {
+		c.record(false, b[:n], &c.seqIn, &c.seqOut)
+	}
+	return n, err
+}
+
+func (c *captureConn) Write(b []byte) (int, error) {
+	n, err := c.Conn.Write(b)
+	if n > 0 && c.sink != nil {
+		c.record(true, b[:n], &c.seqOut, &c.seqIn)
+	}
+	return n, err
+}
+
+func (c *captureConn) record(out bool, b []byte, seq *uint32, ack *uint32) {
+	next := atomic.AddUint32(seq, uint32(len(b)))
+	p := CapturePacket{
+		Time:     time.Now(),
+		Local:    c.local,
+		Remote:   c.remote,
+		Outbound: out,
+		Seq:      next - uint32(len(b)),
+		Ack:      atomic.LoadUint32(ack),
+		Data:     append([]byte(nil), b...),
+	}
+	if err := c.sink.WritePacket(p); err != nil {
+		logger().Warn("CAPTURE: WritePacket", "err", err)
+	}
+}
+
+// RingCaptureSize is the Size of a RingCapture created with none
+const RingCaptureSize = 16 << 20
+
+// RingCapture keeps the most recent Size bytes of traffic in memory and
+// writes them to Dir/Name-<time>.pcapng on Dump. A zero Size keeps
+// RingCaptureSize bytes, an empty Name is replaced by the device's MAC
+// address when the sink is passed to WithCapture.
+type RingCapture struct {
+	Dir  string
+	Name string
+	Size int
+
+	mu      sync.Mutex
+	packets []CapturePacket
+	used    int
+}
+
+func NewRingCapture(dir string, name string, size int) *RingCapture {
+	return &RingCapture{Dir: dir, Name: name, Size: size}
+}
+
+func (r *RingCapture) WritePacket(p CapturePacket) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.packets = append(r.packets, p)
+	r.used += len(p.Data)
+	size := r.Size
+	if size <= 0 {
+		size = RingCaptureSize
+	}
+	for r.used > size && len(r.packets) > 0 {
+		r.used -= len(r.packets[0].Data)
+		r.packets[0] = CapturePacket{}
+		r.packets = r.packets[1:]
+	}
+	return nil
+}
+
+func (r *RingCapture) Dump() error {
+	r.mu.Lock()
+	packets := append([]CapturePacket(nil), r.packets...)
+	name := r.Name
+	r.mu.Unlock()
+
+	fn := filepath.Join(r.Dir, captureFilename(name, time.Now()))
+	f, err := os.Create(fn)
+	if err != nil {
+		return errors.Wrap(err, "RingCapture: Unable to Create")
+	}
+	w, err := newPcapngWriter(f)
+	for i := 0; err == nil && i < len(packets); i++ {
+		err = w.WritePacket(packets[i])
+	}
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	return errors.Wrap(err, "RingCapture: Unable to Dump")
+}
+
+func (r *RingCapture) defaultName(name string) {
+	r.mu.Lock()
+	if r.Name == "" {
+		r.Name = name
+	}
+	r.mu.Unlock()
+}
+
+func (r *RingCapture) Close() error {
+	r.mu.Lock()
+	r.packets = nil
+	r.used = 0
+	r.mu.Unlock()
+	return nil
+}
+
+// FileCapture continuously writes traffic to Dir/Name-<time>.pcapng, starting
+// a new file once MaxSize bytes are written and keeping at most MaxFiles.
+// Zero MaxSize or MaxFiles disables rotation or deletion. An empty Name is
+// replaced by the device's MAC address when the sink is passed to WithCapture.
+type FileCapture struct {
+	Dir      string
+	Name     string
+	MaxSize  int64
+	MaxFiles int
+
+	mu      sync.Mutex
+	f       *os.File
+	w       *pcapngWriter
+	written int64
+}
+
+func NewFileCapture(dir string, name string, maxSize int64, maxFiles int) *FileCapture {
+	return &FileCapture{Dir: dir, Name: name, MaxSize: maxSize, MaxFiles: maxFiles}
+}
+
+func (c *FileCapture) WritePacket(p CapturePacket) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.f != nil && c.MaxSize > 0 && c.written >= c.MaxSize {
+		c.f.Close()
+		c.f = nil
+	}
+	if c.f == nil {
+		if err := c.rotate(); err != nil {
+			return err
+		}
+	}
+	before := c.w.n
+	err := c.w.WritePacket(p)
+	c.written += c.w.n - before
+	return errors.Wrap(err, "FileCapture: Unable to Write")
+}
+
+// rotate opens a new file and removes old ones. c.mu must be held.
+func (c *FileCapture) rotate() error {
+	f, err := os.Create(filepath.Join(c.Dir, captureFilename(c.Name, time.Now())))
+	if err != nil {
+		return errors.Wrap(err, "FileCapture: Unable to Create")
+	}
+	w, err := newPcapngWriter(f)
+	if err != nil {
+		f.Close()
+		return errors.Wrap(err, "FileCapture: Unable to Write")
+	}
+	c.f, c.w, c.written = f, w, w.n
+
+	if c.MaxFiles <= 0 {
+		return nil
+	}
+	old, _ := filepath.Glob(filepath.Join(c.Dir, captureName(c.Name)+"-*.pcapng"))
+	sort.Strings(old)
+	for len(old) > c.MaxFiles {
+		os.Remove(old[0])
+		old = old[1:]
+	}
+	return nil
+}
+
+func (c *FileCapture) Dump() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.f == nil {
+		return nil
+	}
+	return c.f.Sync()
+}
+
+func (c *FileCapture) defaultName(name string) {
+	c.mu.Lock()
+	if c.Name == "" {
+		c.Name = name
+	}
+	c.mu.Unlock()
+}
+
+func (c *FileCapture) Close() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.f == nil {
+		return nil
+	}
+	err := c.f.Close()
+	c.f = nil
+	return err
+}
+
+func captureFilename(name string, t time.Time) string {
+	return fmt.Sprintf("%s-%s.pcapng", captureName(name), t.Format("20060102-150405.000000"))
+}
+
+// captureName is name, or "capture" for a sink used without a Lockdown
+func captureName(name string) string {
+	if name == "" {
+		return "capture"
+	}
+	return name
+}
+
+// pcapngWriter writes packets as LINKTYPE_RAW IP/TCP so Wireshark's tcp.port
+// table hands them to the lockdownd and AFC dissectors
+type pcapngWriter struct {
+	w io.Writer
+	n int64
+}
+
+func newPcapngWriter(w io.Writer) (*pcapngWriter, error) {
+	p := &pcapngWriter{w: w}
+	// Section Header Block
+	shb := make([]byte, 16)
+	binary.LittleEndian.PutUint32(shb[0:], 0x1A2B3C4D)
+	binary.LittleEndian.PutUint16(shb[4:], 1)
+	binary.LittleEndian.PutUint16(shb[6:], 0)
+	binary.LittleEndian.PutUint64(shb[8:], 0xFFFFFFFFFFFFFFFF)
+	if err := p.block(0x0A0D0D0A, shb); err != nil {
+		return nil, err
+	}
+	// Interface Description Block, LINKTYPE_RAW, microsecond timestamps
+	idb := make([]byte, 8)
+	binary.LittleEndian.PutUint16(idb[0:], 101)
+	return p, p.block(1, idb)
+}
+
+func (p *pcapngWriter) WritePacket(c CapturePacket) error {
+	data := c.Data
+	seq := c.Seq
+	for len(data) > 0 {
+		chunk := data
+		if len(chunk) > 65000 {
+			chunk = chunk[:65000]
+		}
+		pkt := captureIPPacket(c, seq, chunk)
+		epb := make([]byte, 20, 20+len(pkt)+3)
+		ts := uint64(c.Time.UnixNano() / 1000)
+		binary.LittleEndian.PutUint32(epb[4:], uint32(ts>>32))
+		binary.LittleEndian.PutUint32(epb[8:], uint32(ts))
+		binary.LittleEndian.PutUint32(epb[12:], uint32(len(pkt)))
+		binary.LittleEndian.PutUint32(epb[16:], uint32(len(pkt)))
+		epb = append(epb, pkt...)
+		for len(epb)%4 != 0 {
+			epb = append(epb, 0)
+		}
+		if err := p.block(6, epb); err != nil {
+			return err
+		}
+		seq += uint32(len(chunk))
+		data = data[len(chunk):]
+	}
+	return nil
+}
+
+func (p *pcapngWriter) block(t uint32, body []byte) error {
+	buf := make([]byte, 8, 12+len(body))
+	binary.LittleEndian.PutUint32(buf[0:], t)
+	binary.LittleEndian.PutUint32(buf[4:], uint32(12+len(body)))
+	buf = append(buf, body...)
+	buf = append(buf, buf[4:8]...)
+	n, err := p.w.Write(buf)
+	p.n += int64(n)
+	return err
+}
+
+// captureIPPacket builds an IPv4 or IPv6 TCP segment carrying data
+func captureIPPacket(c CapturePacket, seq uint32, data []byte) []byte {
+	src, dst := c.Local, c.Remote
+	ack := c.Ack
+	if !c.Outbound {
+		src, dst = dst, src
+	}
+
+	tcp := make([]byte, 20, 20+len(data))
+	binary.BigEndian.PutUint16(tcp[0:], uint16(src.Port))
+	binary.BigEndian.PutUint16(tcp[2:], uint16(dst.Port))
+	binary.BigEndian.PutUint32(tcp[4:], seq)
+	binary.BigEndian.PutUint32(tcp[8:], ack)
+	tcp[12] = 5 << 4
+	tcp[13] = 0x18 // PSH ACK
+	binary.BigEndian.PutUint16(tcp[14:], 0xFFFF)
+	tcp = append(tcp, data...)
+
+	src4, dst4 := src.IP.To4(), dst.IP.To4()
+	if src4 != nil && dst4 != nil {
+		ip := make([]byte, 20, 20+len(tcp))
+		ip[0] = 0x45
+		binary.BigEndian.PutUint16(ip[2:], uint16(20+len(tcp)))
+		ip[8] = 64
+		ip[9] = 6
+		copy(ip[12:], src4)
+		copy(ip[16:], dst4)
+		binary.BigEndian.PutUint16(ip[10:], ipChecksum(ip))
+		return append(ip, tcp...)
+	}
+	ip := make([]byte, 40, 40+len(tcp))
+	ip[0] = 0x60
+	binary.BigEndian.PutUint16(ip[4:], uint16(len(tcp)))
+	ip[6] = 6
+	ip[7] = 64
+	copy(ip[8:], src.IP.To16())
+	copy(ip[24:], dst.IP.To16())
+	return append(ip, tcp...)
+}
+
+func ipChecksum(b []byte) uint16 {
+	var sum uint32
+	for i := 0; i+1 < len(b); i += 2 {
+		sum += uint32(binary.BigEndian.Uint16(b[i:]))
+	}
+	for sum > 0xFFFF {
+		sum = sum>>16 + sum&0xFFFF
+	}
+	return ^uint16(sum)
+}
@@ -0,0 +1,154 @@
+package itunes
+
+import "bytes"
+import "net"
+import "os"
+import "path/filepath"
+import "strings"
+import "testing"
+import "time"
+import "encoding/binary"
+
+type pcapngBlock struct {
+	Type uint32
+	Body []byte
+}
+
+// readPcapng splits a little endian pcapng file into blocks, checking every
+// block is padded to 32 bits and ends with its own length
+func readPcapng(t *testing.T, buf []byte) []pcapngBlock {
+	t.Helper()
+	var blocks []pcapngBlock
+	for len(buf) > 0 {
+		if len(buf) < 12 {
+			t.Fatalf("%d trailing bytes", len(buf))
+		}
+		typ := binary.LittleEndian.Uint32(buf[0:])
+		n := binary.LittleEndian.Uint32(buf[4:])
+		if n < 12 || n%4 != 0 || int(n) > len(buf) {
+			t.Fatalf("block %#x: bad length %d, %d bytes left", typ, n, len(buf))
+		}
+		if trailer := binary.LittleEndian.Uint32(buf[n-4:]); trailer != n {
+			t.Fatalf("block %#x: trailing length %d, want %d", typ, trailer, n)
+		}
+		blocks = append(blocks, pcapngBlock{typ, buf[8 : n-4]})
+		buf = buf[n:]
+	}
+	return blocks
+}
+
+func TestFileCapturePcapng(t *testing.T) {
+	dir := t.TempDir()
+	c := NewFileCapture(dir, "", 0, 0)
+	l := &Lockdown{capture: c, pair: PairRecord{WiFiMACAddress: "AA:BB:CC:DD:EE:FF"}}
+	l.nameCapture(l.pair.WiFiMACAddress)
+
+	local := &net.TCPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 50000}
+	remote := &net.TCPAddr{IP: net.IPv4(127, 0, 0, 2), Port: LockdownPort}
+	packets := []CapturePacket{
+		{Time: time.Now(), Local: local, Remote: remote, Outbound: true, Seq: 1, Data: []byte("hello")},
+		{Time: time.Now(), Local: local, Remote: remote, Seq: 7, Ack: 6, Data: []byte("world!")},
+		{
+			Time:     time.Now(),
+			Local:    &net.TCPAddr{IP: net.ParseIP("fe80::1"), Port: 50001},
+			Remote:   &net.TCPAddr{IP: net.ParseIP("fe80::2"), Port: LockdownPort},
+			Outbound: true,
+			Data:     []byte("v6"),
+		},
+	}
+	for _, p := range packets {
+		if err := c.WritePacket(p); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := c.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	files, _ := filepath.Glob(filepath.Join(dir, "*.pcapng"))
+	if len(files) != 1 || !strings.HasPrefix(filepath.Base(files[0]), "aabbccddeeff-") {
+		t.Fatalf("files %v, want one named after the MAC address", files)
+	}
+	buf, err := os.ReadFile(files[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	blocks := readPcapng(t, buf)
+	if len(blocks) != 2+len(packets) {
+		t.Fatalf("%d blocks, want %d", len(blocks), 2+len(packets))
+	}
+
+	shb := blocks[0]
+	if shb.Type != 0x0A0D0D0A || binary.LittleEndian.Uint32(shb.Body) != 0x1A2B3C4D {
+		t.Fatalf("section header %#x %x", shb.Type, shb.Body)
+	}
+	idb := blocks[1]
+	if idb.Type != 1 || binary.LittleEndian.Uint16(idb.Body) != 101 {
+		t.Fatalf("interface description %#x %x", idb.Type, idb.Body)
+	}
+
+	for i, b := range blocks[2:] {
+		p := packets[i]
+		if b.Type != 6 {
+			t.Fatalf("packet %d: block type %#x", i, b.Type)
+		}
+		caplen := binary.LittleEndian.Uint32(b.Body[12:])
+		if origlen := binary.LittleEndian.Uint32(b.Body[16:]); caplen != origlen {
+			t.Errorf("packet %d: captured %d of %d bytes", i, caplen, origlen)
+		}
+		if pad := (4 - caplen%4) % 4; len(b.Body) != 20+int(caplen+pad) {
+			t.Errorf("packet %d: body %d bytes for %d captured", i, len(b.Body), caplen)
+		}
+		ts := uint64(binary.LittleEndian.Uint32(b.Body[4:]))<<32 | uint64(binary.LittleEndian.Uint32(b.Body[8:]))
+		if want := uint64(p.Time.UnixNano() / 1000); ts != want {
+			t.Errorf("packet %d: timestamp %d, want %d", i, ts, want)
+		}
+
+		pkt := b.Body[20 : 20+caplen]
+		hdr := 20
+		if p.Local.IP.To4() == nil {
+			hdr = 40
+		}
+		if version := pkt[0] >> 4; (hdr == 20) != (version == 4) {
+			t.Errorf("packet %d: IP version %d", i, version)
+		}
+		tcp := pkt[hdr:]
+		src, dst := int(binary.BigEndian.Uint16(tcp[0:])), int(binary.BigEndian.Uint16(tcp[2:]))
+		if !p.Outbound {
+			src, dst = dst, src
+		}
+		if src != p.Local.Port || dst != p.Remote.Port {
+			t.Errorf("packet %d: ports %d > %d", i, src, dst)
+		}
+		if seq := binary.BigEndian.Uint32(tcp[4:]); seq != p.Seq {
+			t.Errorf("packet %d: seq %d, want %d", i, seq, p.Seq)
+		}
+		if !bytes.Equal(tcp[20:], p.Data) {
+			t.Errorf("packet %d: payload %q, want %q", i, tcp[20:], p.Data)
+		}
+	}
+}
+
+func TestRingCaptureDefaultSize(t *testing.T) {
+	dir := t.TempDir()
+	r := NewRingCapture(dir, "ring", 0)
+	local := &net.TCPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 50000}
+	remote := &net.TCPAddr{IP: net.IPv4(127, 0, 0, 2), Port: LockdownPort}
+	for i := 0; i < 3; i++ {
+		r.WritePacket(CapturePacket{Time: time.Now(), Local: local, Remote: remote, Outbound: true, Data: []byte("data")})
+	}
+	if err := r.Dump(); err != nil {
+		t.Fatal(err)
+	}
+	files, _ := filepath.Glob(filepath.Join(dir, "ring-*.pcapng"))
+	if len(files) != 1 {
+		t.Fatalf("files %v", files)
+	}
+	buf, err := os.ReadFile(files[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	if blocks := readPcapng(t, buf); len(blocks) != 2+3 {
+		t.Fatalf("%d blocks, want %d", len(blocks), 2+3)
+	}
+}
@@ -0,0 +1,68 @@
+package itunes
+
+import "context"
+import "errors"
+import "sync/atomic"
+
+// Close stops the session. Requests in flight finish first, then
+// StopSession is sent and the heartbeat stopped. If ctx is done before that
+// the connection is closed regardless. Later requests fail with
+// ErrSessionClosed.
+func (l *Lockdown) Close(ctx context.Context) error {
+	done := make(chan error, 1)
+	go func() { done <- l.shutdown(true) }()
+
+	var errs []error
+	select {
+	case err := <-done:
+		errs = append(errs, err)
+		if l.hbDone != nil {
+			select {
+			case <-l.hbDone:
+			case <-ctx.Done():
+				errs = append(errs, ctx.Err())
+			}
+		}
+	case <-ctx.Done():
+		errs = append(errs, ctx.Err())
+		l.c.Close()
+	}
+	return errors.Join(errs...)
+}
+
+// Close waits for the request in flight, if any, and closes the service
+// connection. The session is left running. If ctx is done first the request
+// is aborted.
+func (afc *AfcConn) Close(ctx context.Context) error {
+	atomic.StoreInt32(&afc.closing, 1)
+	if afc.cancel != nil {
+		afc.cancel()
+	}
+	idle := make(chan struct{})
+	go func() {
+		afc.mu.Lock()
+		afc.mu.Unlock()
+		close(idle)
+	}()
+
+	var err error
+	select {
+	case <-idle:
+	case <-ctx.Done():
+		err = ctx.Err()
+	}
+	return errors.Join(err, afc.Conn.Close())
+}
+
+func (afc *AfcConn) isClosing() bool {
+	return atomic.LoadInt32(&afc.closing) != 0
+}
+
+// Close releases the power assertion, closes AFC and stops the session. A
+// request waiting for Give fails with ErrSessionClosed.
+func (afc *AfcRetryConn) Close(ctx context.Context) error {
+	afc.closeOnce.Do(func() { close(afc.closed) })
+	afc.mu.Lock()
+	defer afc.mu.Unlock()
+	return afc.disconnect(ctx)
+}
@@ -0,0 +1,332 @@
+package itunes
+
+import "os"
+import "net"
+import "sync"
+import "strings"
+import "bytes"
+import "path/filepath"
+import "io/ioutil"
+import "crypto/aes"
+import "crypto/cipher"
+import "crypto/pbkdf2"
+import "crypto/rand"
+import "crypto/sha256"
+import "github.com/pkg/errors"
+import "github.com/DHowett/go-plist"
+
+// KeyProvider supplies the 32 byte AES-256 key used to encrypt pair records.
+// salt is unique to each EncryptedPairStore directory.
+type KeyProvider interface {
+	Key(salt []byte) ([]byte, error)
+}
+
+// PassphraseKeyProvider derives the key from a passphrase with
+// PBKDF2-SHA256. The derived key is cached for the last salt seen, until
+// Clear is called.
+type PassphraseKeyProvider struct {
+	Passphrase string
+	Iterations int
+	mu         sync.Mutex
+	salt       []byte
+	key        []byte
+}
+
+// PassphraseIterations is the default PBKDF2 iteration count
+const PassphraseIterations = 600000
+
+func NewPassphraseKeyProvider(passphrase string) *PassphraseKeyProvider {
+	return &PassphraseKeyProvider{Passphrase: passphrase, Iterations: PassphraseIterations}
+}
+
+func (p *PassphraseKeyProvider) Key(salt []byte) ([]byte, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.key != nil && bytes.Equal(p.salt, salt) {
+		return p.key, nil
+	}
+	key, err := pbkdf2.Key(sha256.New, p.Passphrase, salt, p.Iterations, 32)
+	if err != nil {
+		return nil, errors.Wrap(err, "PassphraseKeyProvider")
+	}
+	p.salt = append([]byte(nil), salt...)
+	p.key = key
+	return key, nil
+}
+
+// Clear wipes the cached key, the next Key derives it again
+func (p *PassphraseKeyProvider) Clear() {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	wipe(p.key)
+	p.key = nil
+	p.salt = nil
+}
+
+// StaticKeyProvider returns a fixed key, for keys held in an external
+// secrets store
+type StaticKeyProvider []byte
+
+func (k StaticKeyProvider) Key(salt []byte) ([]byte, error) {
+	if len(k) != 32 {
+		return nil, errors.New("StaticKeyProvider: Key must be 32 bytes")
+	}
+	return k, nil
+}
+
+const cryptMagic = "IMPR1"
+
+type cryptIndex struct {
+	mac  string
+	host string
+}
+
+// EncryptedPairStore is a PairStore of AES-256-GCM encrypted <UDID>.plist.enc
+// files. Only the WiFiMACAddress and HostID of each record are kept in memory,
+// records are decrypted on every Get.
+type EncryptedPairStore struct {
+	dir   string
+	keys  KeyProvider
+	salt  []byte
+	mu    sync.RWMutex
+	index map[string]cryptIndex
+}
+
+// NewEncryptedPairStore opens dir, creating its salt if needed. A
+// MalformedPairRecordError is returned alongside a usable store if some files
+// could not be decrypted.
+func NewEncryptedPairStore(dir string, keys KeyProvider) (*EncryptedPairStore, error) {
+	s := &EncryptedPairStore{dir: dir, keys: keys, index: make(map[string]cryptIndex)}
+	salt, err := ioutil.ReadFile(filepath.Join(dir, ".salt"))
+	if os.IsNotExist(err) {
+		salt = make([]byte, 16)
+		if _, err := rand.Read(salt); err != nil {
+			return nil, errors.Wrap(err, "EncryptedPairStore: Unable to Generate Salt")
+		}
+		err = ioutil.WriteFile(filepath.Join(dir, ".salt"), salt, 0600)
+	}
+	if err != nil {
+		return nil, errors.Wrap(err, "EncryptedPairStore: Salt")
+	}
+	s.salt = salt
+	return s, s.Reload()
+}
+
+// Reload rescans the directory
+func (s *EncryptedPairStore) Reload() error {
+	entries, err := ioutil.ReadDir(s.dir)
+	if err != nil {
+		return errors.Wrap(err, "EncryptedPairStore: Unable to Read Directory")
+	}
+	index := make(map[string]cryptIndex)
+	malformed := make(map[string]error)
+	for _, e := range entries {
+		if e.IsDir() || !strings.HasSuffix(e.Name(), ".plist.enc") {
+			continue
+		}
+		UDID := strings.TrimSuffix(e.Name(), ".plist.enc")
+		pair, err := s.read(UDID)
+		if err != nil {
+			malformed[filepath.Join(s.dir, e.Name())] = err
+			continue
+		}
+		index[UDID] = newCryptIndex(pair)
+		pair.Wipe()
+	}
+
+	s.mu.Lock()
+	s.index = index
+	s.mu.Unlock()
+
+	if len(malformed) != 0 {
+		return &MalformedPairRecordError{malformed}
+	}
+	return nil
+}
+
+// Get decrypts the record for UDID. The caller owns the returned record and
+// should Wipe it when done.
+func (s *EncryptedPairStore) Get(UDID string) (PairRecord, error) {
+	s.mu.RLock()
+	_, ok := s.index[UDID]
+	s.mu.RUnlock()
+	if !ok {
+		return PairRecord{}, ENOPAIRRECORD
+	}
+	return s.read(UDID)
+}
+
+func (s *EncryptedPairStore) ByWiFiMACAddress(mac string) (string, PairRecord, error) {
+	hw, err := net.ParseMAC(mac)
+	if err != nil {
+		return "", PairRecord{}, errors.Wrap(err, "PairStore: Invalid MAC Address")
+	}
+	return s.find(func(i cryptIndex) bool { return i.mac == hw.String() })
+}
+
+func (s *EncryptedPairStore) ByHostID(HostID string) (string, PairRecord, error) {
+	HostID = strings.ToUpper(HostID)
+	return s.find(func(i cryptIndex) bool { return i.host == HostID })
+}
+
+// List decrypts every record
+func (s *EncryptedPairStore) List() (map[string]PairRecord, error) {
+	s.mu.RLock()
+	var UDIDs []string
+	for UDID := range s.index {
+		UDIDs = append(UDIDs, UDID)
+	}
+	s.mu.RUnlock()
+	ret := make(map[string]PairRecord)
+	for _, UDID := range UDIDs {
+		pair, err := s.read(UDID)
+		if err != nil {
+			return nil, err
+		}
+		ret[UDID] = pair
+	}
+	return ret, nil
+}
+
+func (s *EncryptedPairStore) Put(UDID string, pair PairRecord) error {
+	if UDID == "" || strings.ContainsAny(UDID, "/\\") {
+		return errors.New("PairStore: Invalid UDID")
+	}
+	buf, err := plist.Marshal(pair, plist.BinaryFormat)
+	if err != nil {
+		return errors.Wrap(err, "EncryptedPairStore: Unable to Marshal")
+	}
+	defer wipe(buf)
+	aead, err := s.aead()
+	if err != nil {
+		return err
+	}
+	nonce := make([]byte, aead.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return errors.Wrap(err, "EncryptedPairStore: Unable to Generate Nonce")
+	}
+	out := append([]byte(cryptMagic), nonce...)
+	out = aead.Seal(out, nonce, buf, []byte(UDID))
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	fn := s.filename(UDID)
+	if err := ioutil.WriteFile(fn+".tmp", out, 0600); err != nil {
+		return errors.Wrap(err, "EncryptedPairStore: Unable to Write")
+	}
+	if err := os.Rename(fn+".tmp", fn); err != nil {
+		os.Remove(fn + ".tmp")
+		return errors.Wrap(err, "EncryptedPairStore: Unable to Rename")
+	}
+	s.index[UDID] = newCryptIndex(pair)
+	return nil
+}
+
+func (s *EncryptedPairStore) Remove(UDID string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, ok := s.index[UDID]; !ok {
+		return ENOPAIRRECORD
+	}
+	err := os.Remove(s.filename(UDID))
+	if err != nil && !os.IsNotExist(err) {
+		return errors.Wrap(err, "EncryptedPairStore: Unable to Remove")
+	}
+	delete(s.index, UDID)
+	return nil
+}
+
+func (s *EncryptedPairStore) find(match func(cryptIndex) bool) (string, PairRecord, error) {
+	s.mu.RLock()
+	var UDID string
+	for k, v := range s.index {
+		if match(v) {
+			UDID = k
+			break
+		}
+	}
+	s.mu.RUnlock()
+	if UDID == "" {
+		return "", PairRecord{}, ENOPAIRRECORD
+	}
+	pair, err := s.read(UDID)
+	return UDID, pair, err
+}
+
+func (s *EncryptedPairStore) filename(UDID string) string {
+	return filepath.Join(s.dir, UDID+".plist.enc")
+}
+
+func (s *EncryptedPairStore) aead() (cipher.AEAD, error) {
+	key, err := s.keys.Key(s.salt)
+	if err != nil {
+		return nil, err
+	}
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, errors.Wrap(err, "EncryptedPairStore: Invalid Key")
+	}
+	return cipher.NewGCM(block)
+}
+
+func (s *EncryptedPairStore) read(UDID string) (PairRecord, error) {
+	buf, err := ioutil.ReadFile(s.filename(UDID))
+	if err != nil {
+		return PairRecord{}, errors.Wrap(err, "EncryptedPairStore: Unable to Read")
+	}
+	aead, err := s.aead()
+	if err != nil {
+		return PairRecord{}, err
+	}
+	if len(buf) < len(cryptMagic)+aead.NonceSize() || string(buf[:len(cryptMagic)]) != cryptMagic {
+		return PairRecord{}, errors.New("EncryptedPairStore: Invalid File")
+	}
+	buf = buf[len(cryptMagic):]
+	plain, err := aead.Open(nil, buf[:aead.NonceSize()], buf[aead.NonceSize():], []byte(UDID))
+	if err != nil {
+		return PairRecord{}, errors.Wrap(err, "EncryptedPairStore: Unable to Decrypt")
+	}
+	defer wipe(plain)
+	var v PairRecord
+	_, err = plist.Unmarshal(plain, &v)
+	if err != nil {
+		return PairRecord{}, errors.Wrap(err, "EncryptedPairStore: Unable to Unmarshal")
+	}
+	return v, nil
+}
+
+func newCryptIndex(pair PairRecord) cryptIndex {
+	var i cryptIndex
+	if hw, err := net.ParseMAC(pair.WiFiMACAddress); err == nil {
+		i.mac = hw.String()
+	}
+	i.host = strings.ToUpper(pair.HostID)
+	return i
+}
+
+// Wipe zeroes the private keys and escrow bag held by p
+func (p *PairRecord) Wipe() {
+	wipe(p.HostPrivateKey)
+	wipe(p.RootPrivateKey)
+	wipe(p.EscrowBag)
+	p.HostPrivateKey = nil
+	p.RootPrivateKey = nil
+	p.EscrowBag = nil
+}
+
+func wipe(b []byte) {
+	for i := range b {
+		b[i] = 0
+	}
+}
+
+// ConnectFromStore connects using the PairRecord for UDID in store. The
+// record's private keys are wiped once Connect returns.
+func ConnectFromStore(addr net.IP, store PairStore, UDID string, opts ...Option) (*Lockdown, error) {
+	pair, err := store.Get(UDID)
+	if err != nil {
+		return nil, err
+	}
+	defer pair.Wipe()
+	return Connect(addr, pair, opts...)
+}
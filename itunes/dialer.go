@@ -0,0 +1,99 @@
+package itunes
+
+import "net"
+import "strconv"
+import "time"
+import "net/netip"
+
+// LockdownPort is the device port lockdownd listens on
+const LockdownPort = 62078
+
+// DialTimeout bounds each TCP connection attempt, so a stale address does not
+// hold up the next candidate for the operating system's connect timeout
+var DialTimeout = 5 * time.Second
+
+// DeviceDialer opens connections to ports on a single device. A Lockdown
+// starts every service over the dialer its session used.
+type DeviceDialer interface {
+	DialPort(port int) (net.Conn, error)
+}
+
+// WithDialer connects over d instead of TCP to the address given to Connect,
+// which may then be nil
+func WithDialer(d DeviceDialer) Option {
+	return func(l *Lockdown) {
+		l.dialer = d
+	}
+}
+
+// TCPDialer connects to the device over the network, e.g. Wi-Fi. Link-local
+// IPv6 addresses without a Zone use the interface found by SelectInterface.
+// A non zero Port replaces LockdownPort.
+type TCPDialer struct {
+	IP   net.IP
+	Zone string
+	Port int
+}
+
+// NewTCPDialer returns a TCPDialer for ap, keeping its zone
+func NewTCPDialer(ap netip.AddrPort) TCPDialer {
+	a := ap.Addr()
+	return TCPDialer{IP: net.IP(a.Unmap().AsSlice()), Zone: a.Zone(), Port: int(ap.Port())}
+}
+
+func (d TCPDialer) DialPort(port int) (net.Conn, error) {
+	if port == LockdownPort && d.Port != 0 {
+		port = d.Port
+	}
+	zone := d.Zone
+	if zone == "" && d.IP.IsLinkLocalUnicast() && d.IP.To4() == nil {
+		var err error
+		zone, err = SelectInterface(d.IP)
+		if err != nil {
+			return nil, err
+		}
+		c, err := dialTCP(d.IP, zone, port)
+		if err != nil {
+			forgetInterface(d.IP)
+		}
+		return c, err
+	}
+	return dialTCP(d.IP, zone, port)
+}
+
+func (d TCPDialer) String() string {
+	return (&net.IPAddr{IP: d.IP, Zone: d.Zone}).String()
+}
+
+func dialTCP(ip net.IP, zone string, port int) (net.Conn, error) {
+	host := (&net.IPAddr{IP: ip, Zone: zone}).String()
+	return net.DialTimeout("tcp", net.JoinHostPort(host, strconv.Itoa(port)), DialTimeout)
+}
+
+// ConnectIPAddr is Connect for an address with an IPv6 zone
+func ConnectIPAddr(addr net.IPAddr, pair PairRecord, opts ...Option) (*Lockdown, error) {
+	opts = append([]Option{WithDialer(TCPDialer{IP: addr.IP, Zone: addr.Zone})}, opts...)
+	return Connect(addr.IP, pair, opts...)
+}
+
+// ConnectAddrPort is Connect for a netip.AddrPort. The port is used for
+// lockdownd, zero means LockdownPort.
+func ConnectAddrPort(addr netip.AddrPort, pair PairRecord, opts ...Option) (*Lockdown, error) {
+	d := NewTCPDialer(addr)
+	opts = append([]Option{WithDialer(d)}, opts...)
+	return Connect(d.IP, pair, opts...)
+}
+
+// PipeDialer connects to in-process handlers over net.Pipe, for tests. The
+// function is called in a new goroutine with the device end of the pipe.
+type PipeDialer func(port int, c net.Conn)
+
+func (d PipeDialer) DialPort(port int) (net.Conn, error) {
+	client, device := net.Pipe()
+	go d(port, device)
+	return client, nil
+}
+
+func (d PipeDialer) String() string {
+	return "pipe"
+}
@@ -6,18 +6,142 @@ const (
 	EGRACEFULSHUTDOWN iTunesError = iota
 	ENOADDRESSGIVEN
 	EUNEXPECTEDRESPONSE
+	EINVALIDHOSTID
+	EPASSWORDPROTECTED
+	ESESSIONINACTIVE
+	EINVALIDSESSIONID
+	ENORUNNINGSESSION
+	EINVALIDSERVICE
+	ESERVICEPROHIBITED
+	ESERVICELIMIT
+	EPAIRINGDIALOGRESPONSEPENDING
+	EUSERDENIEDPAIRING
+	EINVALIDPAIRRECORD
+	EPAIRINGPROHIBITED
+	EGETPROHIBITED
+	ESETPROHIBITED
+	EREMOVEPROHIBITED
+	EMISSINGKEY
+	EMISSINGVALUE
+	EESCROWLOCKED
+	ENOPAIRRECORD
+	EKEYMISMATCH
+	ECERTIFICATEEXPIRED
+	EDEVICECERTIFICATEMISMATCH
 )
 
+// ErrSessionClosed is returned, possibly wrapped, by requests on a session
+// or service that was closed or lost. Check for it with errors.Is.
+var ErrSessionClosed error = EGRACEFULSHUTDOWN
+
 type Error struct{}
 
 func (e iTunesError) Error() string {
 	switch e {
 	case EGRACEFULSHUTDOWN:
-		return "Device Requested Graceful Shutdown"
+		return "Session Closed"
 	case ENOADDRESSGIVEN:
 		return "Connect called with empty IP address"
 	case EUNEXPECTEDRESPONSE:
 		return "Unexpected Response Recieved"
+	case EINVALIDHOSTID:
+		return "Lockdown: Host is not paired with device (InvalidHostID)"
+	case EPASSWORDPROTECTED:
+		return "Lockdown: Device is locked with a passcode (PasswordProtected)"
+	case ESESSIONINACTIVE:
+		return "Lockdown: No active session (SessionInactive)"
+	case EINVALIDSESSIONID:
+		return "Lockdown: Invalid session ID (InvalidSessionID)"
+	case ENORUNNINGSESSION:
+		return "Lockdown: No running session (NoRunningSession)"
+	case EINVALIDSERVICE:
+		return "Lockdown: Service is not available (InvalidService)"
+	case ESERVICEPROHIBITED:
+		return "Lockdown: Service is prohibited (ServiceProhibited)"
+	case ESERVICELIMIT:
+		return "Lockdown: Too many instances of service (ServiceLimit)"
+	case EPAIRINGDIALOGRESPONSEPENDING:
+		return "Lockdown: Waiting for user to trust host (PairingDialogResponsePending)"
+	case EUSERDENIEDPAIRING:
+		return "Lockdown: User denied pairing (UserDeniedPairing)"
+	case EINVALIDPAIRRECORD:
+		return "Lockdown: Pair record rejected by device (InvalidPairRecord)"
+	case EPAIRINGPROHIBITED:
+		return "Lockdown: Pairing is prohibited over this connection (PairingProhibitedOverThisConnection)"
+	case EGETPROHIBITED:
+		return "Lockdown: GetValue is prohibited (GetProhibited)"
+	case ESETPROHIBITED:
+		return "Lockdown: SetValue is prohibited (SetProhibited)"
+	case EREMOVEPROHIBITED:
+		return "Lockdown: RemoveValue is prohibited (RemoveProhibited)"
+	case EMISSINGKEY:
+		return "Lockdown: Missing key (MissingKey)"
+	case EMISSINGVALUE:
+		return "Lockdown: Missing value (MissingValue)"
+	case EESCROWLOCKED:
+		return "Lockdown: Escrow bag is locked (EscrowLocked)"
+	case ENOPAIRRECORD:
+		return "No pair record found"
+	case EKEYMISMATCH:
+		return "Pair record certificate does not match private key"
+	case ECERTIFICATEEXPIRED:
+		return "Pair record certificate is expired or not yet valid"
+	case EDEVICECERTIFICATEMISMATCH:
+		return "Device certificate does not match pair record"
 	}
 	return "UNHANDLED"
 }
+
+// LockdownError is returned for Error strings from lockdownd which have no
+// matching iTunesError
+type LockdownError string
+
+func (e LockdownError) Error() string {
+	return "Lockdown: " + string(e)
+}
+
+// lockdownError converts the Error field of a lockdown response into an error.
+// Returns nil when the field is empty.
+func lockdownError(e string) error {
+	switch e {
+	case "":
+		return nil
+	case "InvalidHostID":
+		return EINVALIDHOSTID
+	case "PasswordProtected":
+		return EPASSWORDPROTECTED
+	case "SessionInactive":
+		return ESESSIONINACTIVE
+	case "InvalidSessionID":
+		return EINVALIDSESSIONID
+	case "NoRunningSession":
+		return ENORUNNINGSESSION
+	case "InvalidService":
+		return EINVALIDSERVICE
+	case "ServiceProhibited":
+		return ESERVICEPROHIBITED
+	case "ServiceLimit":
+		return ESERVICELIMIT
+	case "PairingDialogResponsePending":
+		return EPAIRINGDIALOGRESPONSEPENDING
+	case "UserDeniedPairing":
+		return EUSERDENIEDPAIRING
+	case "InvalidPairRecord":
+		return EINVALIDPAIRRECORD
+	case "PairingProhibitedOverThisConnection":
+		return EPAIRINGPROHIBITED
+	case "GetProhibited":
+		return EGETPROHIBITED
+	case "SetProhibited":
+		return ESETPROHIBITED
+	case "RemoveProhibited":
+		return EREMOVEPROHIBITED
+	case "MissingKey":
+		return EMISSINGKEY
+	case "MissingValue":
+		return EMISSINGVALUE
+	case "EscrowLocked":
+		return EESCROWLOCKED
+	}
+	return LockdownError(e)
+}
@@ -2,44 +2,154 @@ package itunes
 
 import "net"
 import "io"
-import "log"
+import "time"
 import "encoding/binary"
+import "github.com/pkg/errors"
 import "github.com/DHowett/go-plist"
 
+// HeartbeatGrace is how late a Marco may be past the Interval the device
+// asked for before the link is considered dead. It is also how long to wait
+// for the first Marco.
+var HeartbeatGrace = 10 * time.Second
+
 type HeartbeatResponse struct {
 	Command string
 }
 
-func StartHeartbeat(l *Lockdown) {
+type HeartbeatEventType int
+
+const (
+	// HeartbeatMarco is sent for every Marco answered
+	HeartbeatMarco HeartbeatEventType = iota
+	// HeartbeatSleepyTime is sent when the device is about to sleep, the
+	// session stops once it is answered
+	HeartbeatSleepyTime
+	// HeartbeatLost is sent when the heartbeat fails or a Marco is missed
+	HeartbeatLost
+)
+
+func (t HeartbeatEventType) String() string {
+	switch t {
+	case HeartbeatMarco:
+		return "Marco"
+	case HeartbeatSleepyTime:
+		return "SleepyTime"
+	case HeartbeatLost:
+		return "Lost"
+	}
+	return "UNHANDLED"
+}
+
+// HeartbeatEvent is delivered to heartbeat handlers. Interval is the current
+// Marco interval, Err is set for HeartbeatLost.
+type HeartbeatEvent struct {
+	Type     HeartbeatEventType
+	Interval time.Duration
+	Err      error
+}
+
+// WithHeartbeatHandler calls f for every heartbeat event of the session.
+// f is called on the heartbeat goroutine and must not block.
+func WithHeartbeatHandler(f func(HeartbeatEvent)) Option {
+	return func(l *Lockdown) {
+		l.OnHeartbeat(f)
+	}
+}
+
+// OnHeartbeat adds a heartbeat handler to a running session, see
+// WithHeartbeatHandler. The returned func removes it.
+func (l *Lockdown) OnHeartbeat(f func(HeartbeatEvent)) func() {
+	l.hbMu.Lock()
+	defer l.hbMu.Unlock()
+	if l.hbHandlers == nil {
+		l.hbHandlers = make(map[int]func(HeartbeatEvent))
+	}
+	id := l.hbNext
+	l.hbNext++
+	l.hbHandlers[id] = f
+	return func() {
+		l.hbMu.Lock()
+		delete(l.hbHandlers, id)
+		l.hbMu.Unlock()
+	}
+}
+
+func (l *Lockdown) heartbeatEvent(e HeartbeatEvent) {
+	l.hbMu.Lock()
+	handlers := make([]func(HeartbeatEvent), 0, len(l.hbHandlers))
+	for _, f := range l.hbHandlers {
+		handlers = append(handlers, f)
+	}
+	l.hbMu.Unlock()
+	for _, f := range handlers {
+		f(e)
+	}
+}
+
+// StartHeartbeat starts the heartbeat service and waits for the first Marco
+// to be answered. The session is stopped when the heartbeat ends.
+func StartHeartbeat(l *Lockdown) error {
 	h, err := l.StartService("com.apple.mobile.heartbeat")
 	if err != nil {
-		panic(err)
+		return errors.Wrap(err, "Unable to Start Heartbeat")
 	}
-	firstbeat := make(chan struct{})
+	l.hb = h
+	l.hbDone = make(chan struct{})
+	firstbeat := make(chan error, 1)
 	go heartbeat(l, h, firstbeat)
-	firstbeat <- struct{}{}
-	close(firstbeat)
+	return <-firstbeat
 }
 
-func stop_heartbeat(l *Lockdown, heartbeat net.Conn) {
-	log.Println("HEARTBEAT: STOP_HEARTBEAT")
+// stop_heartbeat ends the session when the heartbeat stopped by itself.
+// StopSession is only sent when the device said SleepyTime, a lost link
+// would not answer it.
+func stop_heartbeat(l *Lockdown, heartbeat net.Conn, err error) {
+	log := l.serviceLog("com.apple.mobile.heartbeat")
+	log.Debug("HEARTBEAT: STOP_HEARTBEAT")
 	heartbeat.Close()
-	l.StopSession()
+	if l.IsGracefullyShuttingdown() {
+		return
+	}
+	if err != nil {
+		log.Warn("HEARTBEAT: Lost", "err", err)
+		l.metrics.Add("imobile_heartbeat_misses_total", 1, "device", l.device())
+		l.heartbeatEvent(HeartbeatEvent{Type: HeartbeatLost, Err: err})
+	}
+	l.dumpCaptureOnError()
+	if err := l.shutdown(err == nil); err != nil {
+		log.Warn("HEARTBEAT: StopSession", "err", err)
+	}
 }
 
-func heartbeat(l *Lockdown, heartbeat net.Conn, f chan struct{}) {
+func heartbeat(l *Lockdown, heartbeat net.Conn, f chan<- error) {
+	log := l.serviceLog("com.apple.mobile.heartbeat")
 	here := make([]byte, 4)
 	var recv map[string]interface{}
 	var bytes []byte
 	var resp HeartbeatResponse
-	defer stop_heartbeat(l, heartbeat)
+	var err error
+	var sleeping bool
+	interval := time.Duration(0)
+	defer func() {
+		if err == nil && !sleeping {
+			err = EUNEXPECTEDRESPONSE
+		}
+		if f != nil {
+			f <- errors.Wrap(err, "Heartbeat")
+		}
+		stop_heartbeat(l, heartbeat, err)
+		close(l.hbDone)
+	}()
 	for {
 		if l.IsGracefullyShuttingdown() {
 			return
 		}
-		n, err := io.ReadFull(heartbeat, here)
+		heartbeat.SetReadDeadline(time.Now().Add(interval + HeartbeatGrace))
+		var n int
+		n, err = io.ReadFull(heartbeat, here)
 		if err != nil || n != 4 {
-			log.Println("HEARTBEAT: Read4 ", n, err)
+			log.Debug("HEARTBEAT: Read4", "n", n, "err", err)
+			err = errors.Wrap(err, "Missed Marco")
 			return
 		}
 		blen := binary.BigEndian.Uint32(here)
@@ -48,48 +158,67 @@ func heartbeat(l *Lockdown, heartbeat net.Conn, f chan struct{}) {
 		}
 		n, err = io.ReadFull(heartbeat, bytes)
 		if err != nil || n != int(blen) {
-			log.Println("HEARTBEAT: FATAL Read", blen, n, err)
+			log.Error("HEARTBEAT: FATAL Read", "length", blen, "n", n, "err", err)
 			return
 		}
 		recv = nil
 		_, err = plist.Unmarshal(bytes, &recv)
 		if err != nil {
-			log.Println("HEARTBEAT: FATAL Unmarshal Query:", err)
+			log.Error("HEARTBEAT: FATAL Unmarshal Query", "err", err)
 			return
 		}
 
-		log.Println("HEARTBEAT ", recv)
+		log.Debug("HEARTBEAT", "request", recv)
 
+		// Interval is an integer or real number of seconds
+		switch v := recv["Interval"].(type) {
+		case uint64:
+			interval = time.Duration(v) * time.Second
+		case int64:
+			interval = time.Duration(v) * time.Second
+		case float64:
+			interval = time.Duration(v * float64(time.Second))
+		}
+
+		var event HeartbeatEventType
 		switch recv["Command"] {
 		case "Marco":
 			resp = HeartbeatResponse{"Polo"}
+			event = HeartbeatMarco
 		case "SleepyTime":
 			resp = HeartbeatResponse{"NightNight"}
+			event = HeartbeatSleepyTime
 		default:
-			log.Println("HEARTBEAT UNKNOWN COMMAND: ", recv["Command"])
-			return
+			log.Warn("HEARTBEAT: Unknown Command", "command", recv["Command"])
+			continue
 		}
 
-		pbytes, err := plist.Marshal(resp, 1)
+		var pbytes []byte
+		pbytes, err = plist.Marshal(resp, 1)
 		if err != nil {
-			log.Println("FATAL: FATAL Marshal:", err)
+			log.Error("HEARTBEAT: FATAL Marshal", "err", err)
 			return
 		}
 		binary.BigEndian.PutUint32(here, uint32(len(pbytes)))
 
 		n, err = heartbeat.Write(here)
 		if err != nil || n != 4 {
-			log.Println("HEARTBEAT: FATAL Write4", n, err)
+			log.Error("HEARTBEAT: FATAL Write4", "n", n, "err", err)
 			return
 		}
 		n, err = heartbeat.Write(pbytes)
 		if err != nil || n != len(pbytes) {
-			log.Println("HEARTBEAT: FATAL Write", len(pbytes), n, err)
+			log.Error("HEARTBEAT: FATAL Write", "length", len(pbytes), "n", n, "err", err)
 			return
 		}
-		if recv["Command"] == "SleepyTime" {
+		l.heartbeatEvent(HeartbeatEvent{Type: event, Interval: interval})
+		if f != nil {
+			f <- nil
+			f = nil
+		}
+		if event == HeartbeatSleepyTime {
+			sleeping = true
 			return
 		}
-		<-f
 	}
 }
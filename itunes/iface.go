@@ -0,0 +1,68 @@
+package itunes
+
+import "net"
+import "sync"
+import "time"
+import "strconv"
+import "github.com/pkg/errors"
+
+// ProbeTimeout bounds each connection attempt made by SelectInterface
+var ProbeTimeout = 2 * time.Second
+
+var selectedInterfaces = struct {
+	sync.Mutex
+	m map[string]string
+}{m: make(map[string]string)}
+
+// SelectInterface finds the interface a link-local address is reachable on
+// by probing LockdownPort through every suitable interface at once. The
+// result is cached until a connection through it fails.
+func SelectInterface(ip net.IP) (string, error) {
+	selectedInterfaces.Lock()
+	zone, ok := selectedInterfaces.m[ip.String()]
+	selectedInterfaces.Unlock()
+	if ok {
+		return zone, nil
+	}
+
+	ifaces, err := net.Interfaces()
+	if err != nil {
+		return "", errors.Wrap(err, "SelectInterface: Unable to List Interfaces")
+	}
+	found := make(chan string, len(ifaces))
+	var wg sync.WaitGroup
+	for _, iface := range ifaces {
+		if iface.Flags&net.FlagUp == 0 || iface.Flags&net.FlagLoopback != 0 || iface.Flags&net.FlagMulticast == 0 {
+			continue
+		}
+		wg.Add(1)
+		go func(name string) {
+			defer wg.Done()
+			host := (&net.IPAddr{IP: ip, Zone: name}).String()
+			c, err := net.DialTimeout("tcp", net.JoinHostPort(host, strconv.Itoa(LockdownPort)), ProbeTimeout)
+			if err != nil {
+				return
+			}
+			c.Close()
+			found <- name
+		}(iface.Name)
+	}
+	go func() {
+		wg.Wait()
+		close(found)
+	}()
+	zone, ok = <-found
+	if !ok {
+		return "", errors.New("SelectInterface: " + ip.String() + " not reachable on any interface")
+	}
+	selectedInterfaces.Lock()
+	selectedInterfaces.m[ip.String()] = zone
+	selectedInterfaces.Unlock()
+	return zone, nil
+}
+
+func forgetInterface(ip net.IP) {
+	selectedInterfaces.Lock()
+	delete(selectedInterfaces.m, ip.String())
+	selectedInterfaces.Unlock()
+}
@@ -1,24 +1,37 @@
 package itunes
 
-import "log"
+import "log/slog"
 import "net"
 import "crypto/tls"
-import "fmt"
 import "github.com/pkg/errors"
-import "github.com/mehmooda/net_dump"
 import "github.com/DHowett/go-plist"
 import "sync"
-
-var looper = loop_pcap.NewLooper(16 * 1024 * 1024) // 16MiB
+import "io"
 
 type Lockdown struct {
-	addr          net.IP
+	dialer        DeviceDialer
 	pair          PairRecord
 	cert          *tls.Certificate
 	c             net.Conn
+	req           sync.Mutex
 	session_id    string
 	about_to_exit sync.Mutex
 	exit          chan struct{}
+	keylog        io.Writer
+	capture       CaptureSink
+	dumpOnError   bool
+	resolver      Resolver
+	hb            net.Conn
+	hbDone        chan struct{}
+	hbMu          sync.Mutex
+	hbHandlers    map[int]func(HeartbeatEvent)
+	hbNext        int
+	assertion     *powerAssertionOption
+	log           *slog.Logger
+	afcRate       int64
+	bandwidth     *RateLimiter
+	priority      Priority
+	metrics       Metrics
 }
 
 func (l *Lockdown) IsGracefullyShuttingdown() bool {
@@ -35,34 +48,63 @@ func (l *Lockdown) StartService(Service string) (net.Conn, error) {
 		return nil, EGRACEFULSHUTDOWN
 	}
 	var res lockdownStartServiceResponse
-	log.Println("StartService:", Service)
+	l.log.Debug("LOCKDOWN: StartService", "service", Service)
 	s := lockdownStartServiceRequest{"2", "StartService", Service}
-	err := sendPlist(l.c, s, &res)
+	err := l.request(s, &res)
 	if err != nil {
 		return nil, errors.Wrap(err, "Unable to Send StartService Response")
 	}
-	log.Println("StartService: Connecting", Service, l.addr, res.Port, res.EnableServiceSSL)
-	tcp, err := net.Dial("tcp", l.addr.String()+":"+fmt.Sprintf("%d", res.Port))
+	if err := lockdownError(res.Error); err != nil {
+		return nil, errors.Wrap(err, "StartService: "+Service)
+	}
+	l.log.Debug("LOCKDOWN: StartService: Connecting", "service", Service, "dialer", l.dialer, "port", res.Port, "ssl", res.EnableServiceSSL)
+	tcp, err := l.dialer.DialPort(res.Port)
 	if err != nil {
 		return nil, errors.Wrap(err, "Unable to connect")
 	}
 	if res.EnableServiceSSL == true {
-		c, err := tls_connect(tcp, l.GetCert())
-		return loop_pcap.Wrap(c, looper), err
+		cert, err := l.GetCert()
+		if err != nil {
+			tcp.Close()
+			return nil, errors.Wrap(err, "StartService: "+Service)
+		}
+		c, err := tls_connect(tcp, cert, l.pair.DeviceCertificate, l.keylog)
+		if err != nil {
+			tcp.Close()
+			return nil, errors.Wrap(err, "StartService: "+Service)
+		}
+		return wrapCapture(c, l.capture, res.Port), nil
 	}
-	return loop_pcap.Wrap(tcp, looper), nil
+	return wrapCapture(tcp, l.capture, res.Port), nil
+}
+
+// request sends one lockdownd request. Services may be started from several
+// goroutines when the session is shared, see SessionPool.
+func (l *Lockdown) request(send interface{}, recv interface{}) error {
+	l.req.Lock()
+	defer l.req.Unlock()
+	return sendPlist(l.c, send, recv)
 }
 
 func (l *Lockdown) GetValue(Key string, recv interface{}) error {
+	return l.GetDomainValue("", Key, recv)
+}
+
+// GetDomainValue reads Key from Domain. An empty Domain is the global domain,
+// an empty Key returns the whole Domain as a dictionary.
+func (l *Lockdown) GetDomainValue(Domain string, Key string, recv interface{}) error {
 	if l.IsGracefullyShuttingdown() {
 		return EGRACEFULSHUTDOWN
 	}
 	var res lockdownGetValueResponse
-	s := lockdownGetValueRequest{"2", "GetValue", Key}
-	err := sendPlist(l.c, s, &res)
+	s := lockdownGetValueRequest{"2", "GetValue", Domain, Key}
+	err := l.request(s, &res)
 	if err != nil {
 		return errors.Wrap(err, "GetValue: Unable to Get Value")
 	}
+	if err := lockdownError(res.Error); err != nil {
+		return errors.Wrap(err, "GetValue: "+Domain+" "+Key)
+	}
 	bytes, err := plist.Marshal(res.Value, 1)
 	if err != nil {
 		return errors.Wrap(err, "GetValue: Unable to ReMarshal")
@@ -74,88 +116,205 @@ func (l *Lockdown) GetValue(Key string, recv interface{}) error {
 	return nil
 }
 
+// StopSession ends the session, see Close
 func (l *Lockdown) StopSession() {
-	var res interface{}
-
-	s := lockdownStopSessionRequest{"2", "StopSession", l.session_id}
-	err := sendPlist(l.c, s, &res)
-	if err != nil {
-		log.Println(err)
+	if err := l.shutdown(true); err != nil {
+		l.log.Warn("LOCKDOWN: StopSession", "err", err)
 	}
-	log.Println(res)
-	log.Println("LOCKDOWN: Disconnect")
+}
+
+// shutdown ends the session, sending StopSession first when the link is
+// still up. Requests in flight hold l.req so finish before StopSession is
+// sent. Later calls do nothing.
+func (l *Lockdown) shutdown(request bool) error {
 	l.about_to_exit.Lock()
-	if !l.IsGracefullyShuttingdown() {
-		close(l.exit)
+	defer l.about_to_exit.Unlock()
+	if l.IsGracefullyShuttingdown() {
+		return nil
+	}
+	var err error
+	if request {
+		var res lockdownStopSessionResponse
+		s := lockdownStopSessionRequest{"2", "StopSession", l.session_id}
+		err = l.request(s, &res)
+		if err == nil {
+			err = lockdownError(res.Error)
+		}
+		err = errors.Wrap(err, "StopSession")
+	}
+	l.log.Debug("LOCKDOWN: Disconnect")
+	close(l.exit)
+	if l.hb != nil {
+		l.hb.Close()
 	}
-	l.about_to_exit.Unlock()
 	l.c.Close()
-	looper.DumpToDisk()
+	return err
 }
 
-func Connect(addr net.IP, pair PairRecord) (l *Lockdown, err error) {
-	if len(addr) == 0 {
-		log.Println("LOCKDOWN: Connect: ", ENOADDRESSGIVEN)
-		return nil, ENOADDRESSGIVEN
+func Connect(addr net.IP, pair PairRecord, opts ...Option) (*Lockdown, error) {
+	l := newLockdown(opts...)
+	l.pair = pair
+	if err := l.connect(addr); err != nil {
+		l.metrics.Add("imobile_lockdown_connect_failures_total", 1, "device", l.device())
+		return nil, err
 	}
+	l.metrics.Add("imobile_lockdown_connects_total", 1, "device", l.device())
+	return l, nil
+}
 
-	log.Println("LOCKDOWN: Connect: ", addr.String())
-
-	c, err := net.Dial("tcp", addr.String()+":62078")
-	if err != nil {
-		log.Println("LOCKDOWN: Connect: Dial: ", err)
-		return nil, errors.Wrap(err, "Unable to Connect to Device")
+// connect dials lockdownd, starts the session and its heartbeat
+func (l *Lockdown) connect(addr net.IP) error {
+	if err := l.dial(addr, l.pair.WiFiMACAddress); err != nil {
+		return err
 	}
-	l = &Lockdown{addr: addr, pair: pair}
-	l.c = loop_pcap.Wrap(c, looper)
 
-	// QUERY REQUEST
-	err = func() error {
-		var res lockdownQueryResponse
-		s := lockdownQueryRequest{"2", "QueryType"}
-		sendPlist(l.c, s, &res)
-		if res.Request != "QueryType" || res.Type != "com.apple.mobile.lockdown" {
-			log.Println("Unexpected QueryType: ", res)
-			return EUNEXPECTEDRESPONSE
+	// STARTSESSION
+	err := func() error {
+		var res lockdownStartSessionResponse
+		s := lockdownStartSessionRequest{l.pair.HostID, "2", "StartSession", l.pair.SystemBUID}
+		if err := l.request(s, &res); err != nil {
+			return err
+		}
+		if err := lockdownError(res.Error); err != nil {
+			return err
 		}
+		l.session_id = res.SessionID
 		return nil
 	}()
 
 	if err != nil {
+		l.log.Warn("LOCKDOWN: StartSession", "err", err)
 		l.c.Close()
-		return nil, errors.Wrap(err, "Unexpected QueryType")
+		return errors.Wrap(err, "Unable to StartSession")
 	}
 
-	// STARTSESSION
-	{
-		var res lockdownStartSessionResponse
-		s := lockdownStartSessionRequest{l.pair.HostID, "2", "StartSession", l.pair.SystemBUID}
-		sendPlist(l.c, s, &res)
-		l.session_id = res.SessionID
+	cert, err := l.GetCert()
+	if err != nil {
+		l.c.Close()
+		return errors.Wrap(err, "Unable to StartSession")
 	}
-
-	l.c.(*loop_pcap.NetWrapper).Conn, err = tls_connect(l.c.(*loop_pcap.NetWrapper).Conn, l.GetCert())
+	tc, err := tls_connect(l.c.(*captureConn).Conn, cert, l.pair.DeviceCertificate, l.keylog)
 	if err != nil {
 		l.c.Close()
-		return nil, errors.Wrap(err, "Unable to StartSession")
+		return errors.Wrap(err, "Unable to StartSession")
 	}
+	l.c.(*captureConn).Conn = tc
+
+	// The parsed certificate is cached, drop the PEM private keys
+	l.pair.HostPrivateKey = nil
+	l.pair.RootPrivateKey = nil
+	l.pair.EscrowBag = nil
 
-	log.Println("LOCKDOWN: Connected: SessionID: ", l.session_id)
+	var UDID string
+	if err := l.GetValue("UniqueDeviceID", &UDID); err == nil {
+		l.log = l.log.With("udid", UDID)
+	}
+	l.log.Debug("LOCKDOWN: Connected", "session", l.session_id)
 
 	//HEARTBEAT
 	l.exit = make(chan struct{})
-	StartHeartbeat(l)
+	if err := StartHeartbeat(l); err != nil {
+		if !l.IsGracefullyShuttingdown() {
+			l.StopSession()
+		}
+		return err
+	}
+
+	return nil
+}
+
+// newLockdown returns an unconnected Lockdown with opts applied
+func newLockdown(opts ...Option) *Lockdown {
+	l := &Lockdown{resolver: DefaultResolver, log: logger(), metrics: nopMetrics{}}
+	for _, o := range opts {
+		o(l)
+	}
+	return l
+}
 
+// dialLockdown connects to lockdownd and checks QueryType without starting a
+// session. Only session-less requests can be sent on the returned Lockdown.
+// With no address or dialer the device is found by resolving mac.
+func dialLockdown(addr net.IP, mac string, opts ...Option) (*Lockdown, error) {
+	l := newLockdown(opts...)
+	if err := l.dial(addr, mac); err != nil {
+		return nil, err
+	}
 	return l, nil
 }
 
-func (l *Lockdown) GetCert() tls.Certificate {
+// dial is dialLockdown for l
+func (l *Lockdown) dial(addr net.IP, mac string) error {
+	l.nameCapture(mac)
+	var dialers []DeviceDialer
+	switch {
+	case l.dialer != nil:
+		dialers = append(dialers, l.dialer)
+	case len(addr) != 0:
+		dialers = append(dialers, TCPDialer{IP: addr})
+	case mac != "":
+		addrs, err := l.resolver.Resolve(mac)
+		if err != nil {
+			return errors.Wrap(err, "Unable to Resolve Device Address")
+		}
+		for _, a := range addrs {
+			dialers = append(dialers, TCPDialer{IP: a.IP, Zone: a.Zone})
+		}
+	}
+	if len(dialers) == 0 {
+		l.log.Debug("LOCKDOWN: Connect", "err", ENOADDRESSGIVEN)
+		return ENOADDRESSGIVEN
+	}
+
+	var c net.Conn
+	var err error
+	for _, d := range dialers {
+		l.log.Debug("LOCKDOWN: Connect", "dialer", d)
+		c, err = d.DialPort(LockdownPort)
+		if err == nil {
+			l.dialer = d
+			break
+		}
+		l.log.Debug("LOCKDOWN: Connect: Dial", "dialer", d, "err", err)
+	}
+	if err != nil {
+		return errors.Wrap(err, "Unable to Connect to Device")
+	}
+	l.c = wrapCapture(c, l.capture, LockdownPort)
+
+	// QUERY REQUEST
+	err = func() error {
+		var res lockdownQueryResponse
+		s := lockdownQueryRequest{"2", "QueryType"}
+		if err := l.request(s, &res); err != nil {
+			return err
+		}
+		if err := lockdownError(res.Error); err != nil {
+			return err
+		}
+		if res.Request != "QueryType" || res.Type != "com.apple.mobile.lockdown" {
+			l.log.Error("LOCKDOWN: Unexpected QueryType", "response", res)
+			return EUNEXPECTEDRESPONSE
+		}
+		return nil
+	}()
+
+	if err != nil {
+		l.c.Close()
+		return errors.Wrap(err, "Unexpected QueryType")
+	}
+	return nil
+}
+
+// GetCert returns the host certificate of the pair record, parsed on first
+// use
+func (l *Lockdown) GetCert() (tls.Certificate, error) {
 	if l.cert == nil {
 		cert, err := tls.X509KeyPair(l.pair.HostCertificate, l.pair.HostPrivateKey)
 		if err != nil {
-			log.Fatal("INVALID HOST CERTIFICATE", err)
+			return tls.Certificate{}, errors.Wrap(EKEYMISMATCH, "HostCertificate: "+err.Error())
 		}
 		l.cert = &cert
 	}
-	return *l.cert
+	return *l.cert, nil
 }
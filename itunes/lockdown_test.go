@@ -0,0 +1,218 @@
+package itunes
+
+import "net"
+import "io"
+import "testing"
+import "crypto/rand"
+import "crypto/rsa"
+import "crypto/tls"
+import "crypto/x509"
+import "encoding/binary"
+import "github.com/pkg/errors"
+import "github.com/DHowett/go-plist"
+
+const fakeHeartbeatPort = 49200
+
+// fakeLockdownd answers lockdownd requests over a PipeDialer. Errors maps a
+// Request, or a GetValue Key or StartService Service, to the Error returned.
+type fakeLockdownd struct {
+	t      *testing.T
+	cert   tls.Certificate
+	values map[string]interface{}
+	errors map[string]string
+}
+
+// newDevicePair returns a PairRecord for a new device key and the
+// certificate the device presents for it
+func newDevicePair(t *testing.T) (PairRecord, tls.Certificate) {
+	t.Helper()
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pub := pemEncode("RSA PUBLIC KEY", x509.MarshalPKCS1PublicKey(&key.PublicKey))
+	pair, err := NewPairRecord(pub, "TEST-SYSTEMBUID")
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, err := tls.X509KeyPair(pair.DeviceCertificate, pemEncode("RSA PRIVATE KEY", x509.MarshalPKCS1PrivateKey(key)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return pair, cert
+}
+
+func newFakeLockdownd(t *testing.T, cert tls.Certificate) *fakeLockdownd {
+	return &fakeLockdownd{
+		t:      t,
+		cert:   cert,
+		values: map[string]interface{}{"UniqueDeviceID": "00008030-TEST", "DeviceName": "Test iPhone"},
+		errors: make(map[string]string),
+	}
+}
+
+func (f *fakeLockdownd) dialer() PipeDialer {
+	return func(port int, c net.Conn) {
+		defer c.Close()
+		switch port {
+		case LockdownPort:
+			f.lockdownd(c)
+		case fakeHeartbeatPort:
+			f.heartbeat(c)
+		}
+	}
+}
+
+func readFrame(c net.Conn) (map[string]interface{}, error) {
+	here := make([]byte, 4)
+	if _, err := io.ReadFull(c, here); err != nil {
+		return nil, err
+	}
+	buf := make([]byte, binary.BigEndian.Uint32(here))
+	if _, err := io.ReadFull(c, buf); err != nil {
+		return nil, err
+	}
+	var v map[string]interface{}
+	_, err := plist.Unmarshal(buf, &v)
+	return v, err
+}
+
+func writeFrame(c net.Conn, v interface{}) error {
+	buf, err := plist.Marshal(v, plist.XMLFormat)
+	if err != nil {
+		return err
+	}
+	here := make([]byte, 4)
+	binary.BigEndian.PutUint32(here, uint32(len(buf)))
+	if _, err := c.Write(append(here, buf...)); err != nil {
+		return err
+	}
+	return nil
+}
+
+func (f *fakeLockdownd) lockdownd(c net.Conn) {
+	for {
+		req, err := readFrame(c)
+		if err != nil {
+			return
+		}
+		request, _ := req["Request"].(string)
+		res := map[string]interface{}{"Request": request}
+		fail := func(name string) bool {
+			if e, ok := f.errors[name]; ok {
+				res["Error"] = e
+				return true
+			}
+			return false
+		}
+		if fail(request) {
+			writeFrame(c, res)
+			continue
+		}
+		switch request {
+		case "QueryType":
+			res["Type"] = "com.apple.mobile.lockdown"
+		case "StartSession":
+			res["SessionID"] = "TEST-SESSION"
+			res["EnableSessionSSL"] = true
+			if err := writeFrame(c, res); err != nil {
+				return
+			}
+			tc := tls.Server(c, &tls.Config{
+				Certificates: []tls.Certificate{f.cert},
+				ClientAuth:   tls.RequireAnyClientCert,
+			})
+			if err := tc.Handshake(); err != nil {
+				return
+			}
+			c = tc
+			continue
+		case "GetValue":
+			key, _ := req["Key"].(string)
+			res["Key"] = key
+			if !fail(key) {
+				res["Value"] = f.values[key]
+			}
+		case "StartService":
+			service, _ := req["Service"].(string)
+			res["Service"] = service
+			if !fail(service) {
+				res["Port"] = fakeHeartbeatPort
+			}
+		case "StopSession":
+			writeFrame(c, res)
+			return
+		default:
+			f.t.Errorf("fake lockdownd: unexpected request %v", req)
+			return
+		}
+		if err := writeFrame(c, res); err != nil {
+			return
+		}
+	}
+}
+
+// heartbeat sends one Marco and waits for Polo, then for the host to hang up
+func (f *fakeLockdownd) heartbeat(c net.Conn) {
+	if err := writeFrame(c, map[string]interface{}{"Command": "Marco", "Interval": 60}); err != nil {
+		return
+	}
+	res, err := readFrame(c)
+	if err != nil {
+		return
+	}
+	if res["Command"] != "Polo" {
+		f.t.Errorf("heartbeat answered %v", res)
+	}
+	io.Copy(io.Discard, c)
+}
+
+func TestConnectPipe(t *testing.T) {
+	pair, cert := newDevicePair(t)
+	f := newFakeLockdownd(t, cert)
+	f.errors["GetProhibited"] = "GetProhibited"
+	f.errors["com.apple.afc"] = "InvalidService"
+
+	l, err := Connect(nil, pair, WithDialer(f.dialer()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.StopSession()
+
+	var name string
+	if err := l.GetValue("DeviceName", &name); err != nil || name != "Test iPhone" {
+		t.Errorf("DeviceName %q, %v", name, err)
+	}
+	if err := l.GetValue("GetProhibited", &name); errors.Cause(err) != EGETPROHIBITED {
+		t.Errorf("GetValue returned %v, want %v", err, EGETPROHIBITED)
+	}
+	if _, err := l.StartService("com.apple.afc"); errors.Cause(err) != EINVALIDSERVICE {
+		t.Errorf("StartService returned %v, want %v", err, EINVALIDSERVICE)
+	}
+	// The session survives errors from the device
+	if err := l.GetValue("UniqueDeviceID", &name); err != nil || name != "00008030-TEST" {
+		t.Errorf("UniqueDeviceID %q, %v", name, err)
+	}
+}
+
+func TestConnectPipeStartSessionError(t *testing.T) {
+	pair, cert := newDevicePair(t)
+	f := newFakeLockdownd(t, cert)
+	f.errors["StartSession"] = "InvalidHostID"
+
+	_, err := Connect(nil, pair, WithDialer(f.dialer()))
+	if errors.Cause(err) != EINVALIDHOSTID {
+		t.Fatalf("Connect returned %v, want %v", err, EINVALIDHOSTID)
+	}
+}
+
+func TestConnectPipeDeviceCertificateMismatch(t *testing.T) {
+	pair, _ := newDevicePair(t)
+	_, other := newDevicePair(t)
+	f := newFakeLockdownd(t, other)
+
+	_, err := Connect(nil, pair, WithDialer(f.dialer()))
+	if errors.Cause(err) != EDEVICECERTIFICATEMISMATCH {
+		t.Fatalf("Connect returned %v, want %v", err, EDEVICECERTIFICATEMISMATCH)
+	}
+}
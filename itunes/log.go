@@ -0,0 +1,40 @@
+package itunes
+
+import "log/slog"
+import "sync/atomic"
+
+var defaultLog atomic.Pointer[slog.Logger]
+
+func init() {
+	SetLogger(nil)
+}
+
+// SetLogger sets the logger used by discovery, pair stores and capture, and
+// by sessions not given WithLogger. The library logs nothing until it is
+// called, a nil logger silences it again.
+func SetLogger(logger *slog.Logger) {
+	if logger == nil {
+		logger = slog.New(slog.DiscardHandler)
+	}
+	defaultLog.Store(logger)
+}
+
+func logger() *slog.Logger {
+	return defaultLog.Load()
+}
+
+// WithLogger logs the session and the services it starts to logger. Records
+// carry the udid of the device and, for services, the service name. Per
+// request and per heartbeat messages are logged at Debug.
+func WithLogger(logger *slog.Logger) Option {
+	return func(l *Lockdown) {
+		if logger != nil {
+			l.log = logger
+		}
+	}
+}
+
+// serviceLog returns the logger for Service on this session
+func (l *Lockdown) serviceLog(Service string) *slog.Logger {
+	return l.log.With("service", Service)
+}
@@ -0,0 +1,413 @@
+package itunes
+
+import "net"
+import "sync"
+import "time"
+import "strings"
+
+type DeviceEventType int
+
+const (
+	DeviceAttached DeviceEventType = iota
+	DevicePaired
+	DeviceConnected
+	DeviceSleeping
+	DeviceDisconnected
+	DeviceDetached
+)
+
+func (t DeviceEventType) String() string {
+	switch t {
+	case DeviceAttached:
+		return "Attached"
+	case DevicePaired:
+		return "Paired"
+	case DeviceConnected:
+		return "Connected"
+	case DeviceSleeping:
+		return "Sleeping"
+	case DeviceDisconnected:
+		return "Disconnected"
+	case DeviceDetached:
+		return "Detached"
+	}
+	return "UNHANDLED"
+}
+
+// DeviceEvent reports a change to a Device. Err is set for disconnects and
+// failed connection attempts.
+type DeviceEvent struct {
+	Type   DeviceEventType
+	Device *Device
+	Err    error
+}
+
+// Device is a device seen by a DeviceManager, over USB, Wi-Fi or both
+type Device struct {
+	UDID string
+
+	mu      sync.Mutex
+	name    string
+	mac     net.HardwareAddr
+	usb     *UsbmuxDevice
+	wifi    bool
+	paired  bool
+	l       *Lockdown
+	running bool
+	changed chan struct{}
+}
+
+// Name is the DeviceName read when the device last connected
+func (d *Device) Name() string {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return d.name
+}
+
+// MAC is the Wi-Fi MAC address of the device
+func (d *Device) MAC() net.HardwareAddr {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return d.mac
+}
+
+// Lockdown returns the current session, or nil when not connected
+func (d *Device) Lockdown() *Lockdown {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return d.l
+}
+
+func (d *Device) present() bool {
+	return d.usb != nil || d.wifi
+}
+
+func (d *Device) notify() {
+	select {
+	case d.changed <- struct{}{}:
+	default:
+	}
+}
+
+// DeviceManager keeps a Lockdown session open to every reachable paired
+// device, reconnecting when sessions are lost. Devices are discovered over
+// usbmuxd and, when Browser is set, Bonjour.
+type DeviceManager struct {
+	Store          PairStore
+	Browser        *BonjourBrowser
+	Usbmux         bool
+	Options        []Option
+	ReconnectDelay time.Duration
+
+	mu       sync.Mutex
+	devices  map[string]*Device
+	usbIDs   map[int]string
+	resolver *AddressResolver
+	events   chan DeviceEvent
+	stop     <-chan struct{}
+	// wg tracks the discovery loops and every run, emitMu guards closing
+	// events against emit
+	wg     sync.WaitGroup
+	emitMu sync.RWMutex
+	closed bool
+}
+
+// Start begins discovery. Events are delivered until stop is closed, after
+// which every session is stopped and the channel closed.
+func (m *DeviceManager) Start(stop <-chan struct{}) (<-chan DeviceEvent, error) {
+	if m.ReconnectDelay == 0 {
+		m.ReconnectDelay = 5 * time.Second
+	}
+	m.devices = make(map[string]*Device)
+	m.usbIDs = make(map[int]string)
+	m.resolver = NewAddressResolver()
+	m.events = make(chan DeviceEvent, 64)
+	m.stop = stop
+
+	if m.Usbmux {
+		usb, err := UsbmuxListen(stop)
+		if err != nil {
+			return nil, err
+		}
+		m.wg.Add(1)
+		go func() {
+			defer m.wg.Done()
+			for e := range usb {
+				m.usbEvent(e)
+			}
+		}()
+	}
+	if m.Browser != nil {
+		if m.Browser.Store == nil {
+			m.Browser.Store = m.Store
+		}
+		bonjour, err := m.Browser.Browse(stop)
+		if err != nil {
+			return nil, err
+		}
+		m.wg.Add(1)
+		go func() {
+			defer m.wg.Done()
+			for e := range bonjour {
+				m.resolver.Observe(e)
+				m.bonjourEvent(e)
+			}
+		}()
+	}
+	go func() {
+		<-stop
+		m.wg.Wait()
+		m.emitMu.Lock()
+		m.closed = true
+		close(m.events)
+		m.emitMu.Unlock()
+	}()
+	return m.events, nil
+}
+
+// Devices returns every known device
+func (m *DeviceManager) Devices() []*Device {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	var ret []*Device
+	for _, d := range m.devices {
+		ret = append(ret, d)
+	}
+	return ret
+}
+
+// ByUDID returns the device with UDID
+func (m *DeviceManager) ByUDID(UDID string) *Device {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.devices[UDID]
+}
+
+// ByName returns a device whose DeviceName matches name, ignoring case
+func (m *DeviceManager) ByName(name string) *Device {
+	for _, d := range m.Devices() {
+		if strings.EqualFold(d.Name(), name) {
+			return d
+		}
+	}
+	return nil
+}
+
+// ByMAC returns the device with Wi-Fi MAC address mac
+func (m *DeviceManager) ByMAC(mac string) *Device {
+	hw, err := net.ParseMAC(mac)
+	if err != nil {
+		return nil
+	}
+	for _, d := range m.Devices() {
+		if d.MAC().String() == hw.String() {
+			return d
+		}
+	}
+	return nil
+}
+
+func (m *DeviceManager) emit(t DeviceEventType, d *Device, err error) {
+	m.emitMu.RLock()
+	defer m.emitMu.RUnlock()
+	if m.closed {
+		return
+	}
+	select {
+	case m.events <- DeviceEvent{t, d, err}:
+	case <-m.stop:
+	}
+}
+
+func (m *DeviceManager) device(UDID string) (*Device, bool) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	d, ok := m.devices[UDID]
+	if !ok {
+		d = &Device{UDID: UDID, changed: make(chan struct{}, 1)}
+		m.devices[UDID] = d
+	}
+	return d, !ok
+}
+
+func (m *DeviceManager) usbEvent(e UsbmuxEvent) {
+	if !e.Attached {
+		m.mu.Lock()
+		UDID, ok := m.usbIDs[e.Device.DeviceID]
+		delete(m.usbIDs, e.Device.DeviceID)
+		m.mu.Unlock()
+		if !ok {
+			return
+		}
+		d, _ := m.device(UDID)
+		d.mu.Lock()
+		d.usb = nil
+		gone := !d.present()
+		d.mu.Unlock()
+		d.notify()
+		if gone {
+			m.emit(DeviceDetached, d, nil)
+		}
+		return
+	}
+	UDID := e.Device.SerialNumber
+	m.mu.Lock()
+	m.usbIDs[e.Device.DeviceID] = UDID
+	m.mu.Unlock()
+	d, _ := m.device(UDID)
+	d.mu.Lock()
+	wasPresent := d.present()
+	usb := e.Device
+	d.usb = &usb
+	d.mu.Unlock()
+	if !wasPresent {
+		m.emit(DeviceAttached, d, nil)
+	}
+	m.attach(d)
+}
+
+func (m *DeviceManager) bonjourEvent(e BonjourEvent) {
+	if e.UDID == "" {
+		if e.Appeared {
+			logger().Debug("DEVICEMANAGER: Unpaired Wi-Fi device", "instance", e.Instance)
+		}
+		return
+	}
+	d, _ := m.device(e.UDID)
+	d.mu.Lock()
+	wasPresent := d.present()
+	d.wifi = e.Appeared
+	d.mac = e.MAC
+	gone := !d.present()
+	d.mu.Unlock()
+	d.notify()
+	switch {
+	case e.Appeared && !wasPresent:
+		m.emit(DeviceAttached, d, nil)
+	case gone && wasPresent:
+		m.emit(DeviceDetached, d, nil)
+	}
+	if e.Appeared {
+		m.attach(d)
+	}
+}
+
+// attach checks d has a pair record and starts its connection loop. Only
+// the MAC address is kept, the record is read again for every connection.
+func (m *DeviceManager) attach(d *Device) {
+	d.mu.Lock()
+	paired := d.paired
+	d.mu.Unlock()
+	if !paired {
+		pair, err := m.findPair(d.UDID)
+		if err != nil {
+			return
+		}
+		d.mu.Lock()
+		d.paired = true
+		if hw, err := net.ParseMAC(pair.WiFiMACAddress); err == nil {
+			d.mac = hw
+		}
+		d.mu.Unlock()
+		pair.Wipe()
+		m.emit(DevicePaired, d, nil)
+	}
+
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if !d.running {
+		d.running = true
+		m.wg.Add(1)
+		go func() {
+			defer m.wg.Done()
+			m.run(d)
+		}()
+	}
+}
+
+func (m *DeviceManager) findPair(UDID string) (PairRecord, error) {
+	if m.Store != nil {
+		pair, err := m.Store.Get(UDID)
+		if err == nil {
+			return pair, nil
+		}
+	}
+	if m.Usbmux {
+		return UsbmuxReadPairRecord(UDID)
+	}
+	return PairRecord{}, ENOPAIRRECORD
+}
+
+// options returns the Connect options for the current transport of d,
+// preferring USB. d.mu must be held.
+func (m *DeviceManager) options(d *Device) []Option {
+	opts := []Option{WithResolver(m.resolver), WithHeartbeatHandler(func(e HeartbeatEvent) {
+		if e.Type == HeartbeatSleepyTime {
+			go m.emit(DeviceSleeping, d, nil)
+		}
+	})}
+	opts = append(opts, m.Options...)
+	if d.usb != nil {
+		opts = append(opts, WithDialer(d.usb.Dialer()))
+	}
+	return opts
+}
+
+func (m *DeviceManager) run(d *Device) {
+	for {
+		d.mu.Lock()
+		if !d.present() {
+			d.running = false
+			d.mu.Unlock()
+			return
+		}
+		opts := m.options(d)
+		d.mu.Unlock()
+
+		pair, err := m.findPair(d.UDID)
+		var l *Lockdown
+		if err == nil {
+			l, err = Connect(nil, pair, opts...)
+			pair.Wipe()
+		}
+		if err == nil {
+			var name string
+			if err := l.GetValue("DeviceName", &name); err == nil {
+				d.mu.Lock()
+				d.name = name
+				d.mu.Unlock()
+			}
+			d.mu.Lock()
+			d.l = l
+			d.mu.Unlock()
+			m.emit(DeviceConnected, d, nil)
+
+			for connected := true; connected; {
+				select {
+				case <-l.exit:
+					connected = false
+				case <-d.changed:
+					d.mu.Lock()
+					connected = d.present()
+					d.mu.Unlock()
+					if !connected {
+						l.StopSession()
+					}
+				case <-m.stop:
+					l.StopSession()
+					return
+				}
+			}
+			d.mu.Lock()
+			d.l = nil
+			d.mu.Unlock()
+		}
+		m.emit(DeviceDisconnected, d, err)
+
+		select {
+		case <-time.After(m.ReconnectDelay):
+		case <-m.stop:
+			return
+		}
+	}
+}
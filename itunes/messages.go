@@ -8,6 +8,7 @@ type lockdownQueryRequest struct {
 type lockdownQueryResponse struct {
 	Request string
 	Type    string
+	Error   string
 }
 
 type lockdownStartSessionRequest struct {
@@ -21,6 +22,7 @@ type lockdownStartSessionResponse struct {
 	EnableSessionSSL bool
 	Request          string
 	SessionID        string
+	Error            string
 }
 
 type lockdownStartServiceRequest struct {
@@ -33,6 +35,7 @@ type lockdownStartServiceResponse struct {
 	Service          string
 	Port             int
 	EnableServiceSSL bool
+	Error            string
 }
 
 type lockdownStopSessionRequest struct {
@@ -41,14 +44,69 @@ type lockdownStopSessionRequest struct {
 	SessionID       string
 }
 
+type lockdownStopSessionResponse struct {
+	Request string
+	Error   string
+}
+
 type lockdownGetValueRequest struct {
 	ProtocolVersion string
 	Request         string
-	Key             string
+	Domain          string `plist:",omitempty"`
+	Key             string `plist:",omitempty"`
 }
 
 type lockdownGetValueResponse struct {
 	Request string
+	Domain  string
 	Key     string
 	Value   interface{}
+	Error   string
+}
+
+type lockdownSetValueRequest struct {
+	ProtocolVersion string
+	Request         string
+	Domain          string `plist:",omitempty"`
+	Key             string
+	Value           interface{}
+}
+
+type lockdownRemoveValueRequest struct {
+	ProtocolVersion string
+	Request         string
+	Domain          string `plist:",omitempty"`
+	Key             string
+}
+
+type lockdownValueResponse struct {
+	Request string
+	Domain  string
+	Key     string
+	Error   string
+}
+
+type lockdownPairRecord struct {
+	DeviceCertificate []byte
+	HostCertificate   []byte
+	RootCertificate   []byte
+	HostID            string
+	SystemBUID        string
+}
+
+type lockdownPairingOptions struct {
+	ExtendedPairingErrors bool
+}
+
+type lockdownPairRequest struct {
+	PairRecord      lockdownPairRecord
+	PairingOptions  *lockdownPairingOptions `plist:",omitempty"`
+	ProtocolVersion string
+	Request         string
+}
+
+type lockdownPairResponse struct {
+	Request   string
+	EscrowBag []byte
+	Error     string
 }
@@ -0,0 +1,212 @@
+package itunes
+
+import "encoding/binary"
+import "fmt"
+import "net/http"
+import "sort"
+import "strconv"
+import "strings"
+import "sync"
+import "time"
+
+// Metrics receives measurements from sessions, see WithMetrics. Labels are
+// name, value pairs. Every metric carries a device label, the Wi-Fi MAC
+// address of the pair record or, when that is empty, its HostID.
+//
+//	imobile_lockdown_connects_total          counter   device
+//	imobile_lockdown_connect_failures_total  counter   device
+//	imobile_heartbeat_misses_total           counter   device
+//	imobile_afc_reconnects_total             counter   device
+//	imobile_afc_request_seconds              histogram device, op
+//	imobile_afc_bytes_total                  counter   device, direction
+//	imobile_afc_errors_total                 counter   device, op, status
+type Metrics interface {
+	Add(name string, value float64, labels ...string)
+	Observe(name string, value float64, labels ...string)
+}
+
+type nopMetrics struct{}
+
+func (nopMetrics) Add(name string, value float64, labels ...string)     {}
+func (nopMetrics) Observe(name string, value float64, labels ...string) {}
+
+// WithMetrics reports the session, its heartbeat and AFC connections to m
+func WithMetrics(m Metrics) Option {
+	return func(l *Lockdown) {
+		if m != nil {
+			l.metrics = m
+		}
+	}
+}
+
+// device is the value of the device label. It only depends on the pair
+// record so failed connects are labelled like established sessions.
+func (l *Lockdown) device() string {
+	if l.pair.WiFiMACAddress != "" {
+		return l.pair.WiFiMACAddress
+	}
+	return l.pair.HostID
+}
+
+var afcOpNames = map[uint64]string{
+	3:    "ReadDirectory",
+	10:   "GetFileInfo",
+	13:   "FileRefOpen",
+	15:   "FileRefRead",
+	16:   "FileRefWrite",
+	17:   "FileRefSeek",
+	20:   "FileRefClose",
+	0x1F: "GetFileHash",
+}
+
+func afcOpName(op uint64) string {
+	if name, ok := afcOpNames[op]; ok {
+		return name
+	}
+	return strconv.FormatUint(op, 10)
+}
+
+// measure records a request of sent bytes. A lost connection counts as an
+// error with status "lost", a status response with its code.
+func (afc *AfcConn) measure(op uint64, d time.Duration, sent int, res *AFCPacket, err error) {
+	m, device, name := afc.l.metrics, afc.l.device(), afcOpName(op)
+	m.Observe("imobile_afc_request_seconds", d.Seconds(), "device", device, "op", name)
+	m.Add("imobile_afc_bytes_total", float64(sent), "device", device, "direction", "sent")
+	if err != nil {
+		m.Add("imobile_afc_errors_total", 1, "device", device, "op", name, "status", "lost")
+		return
+	}
+	m.Add("imobile_afc_bytes_total", float64(40+len(res.vheader)+len(res.payload)), "device", device, "direction", "received")
+	if res.op == 1 {
+		if status := binary.LittleEndian.Uint64(res.vheader); status != 0 {
+			m.Add("imobile_afc_errors_total", 1, "device", device, "op", name, "status", strconv.FormatUint(status, 10))
+		}
+	}
+}
+
+// DefaultBuckets are the upper bounds of histogram buckets in seconds
+var DefaultBuckets = []float64{.005, .01, .025, .05, .1, .25, .5, 1, 2.5, 5, 10}
+
+// PrometheusMetrics keeps Metrics in memory and serves them in the
+// Prometheus text format
+type PrometheusMetrics struct {
+	Buckets []float64
+
+	mu         sync.Mutex
+	counters   map[string]map[string]float64
+	histograms map[string]map[string]*histogram
+}
+
+type histogram struct {
+	bounds []float64
+	counts []uint64
+	count  uint64
+	sum    float64
+}
+
+func NewPrometheusMetrics() *PrometheusMetrics {
+	return &PrometheusMetrics{
+		Buckets:    DefaultBuckets,
+		counters:   make(map[string]map[string]float64),
+		histograms: make(map[string]map[string]*histogram),
+	}
+}
+
+func (m *PrometheusMetrics) Add(name string, value float64, labels ...string) {
+	key := promLabels(labels)
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	c := m.counters[name]
+	if c == nil {
+		c = make(map[string]float64)
+		m.counters[name] = c
+	}
+	c[key] += value
+}
+
+func (m *PrometheusMetrics) Observe(name string, value float64, labels ...string) {
+	key := promLabels(labels)
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	hs := m.histograms[name]
+	if hs == nil {
+		hs = make(map[string]*histogram)
+		m.histograms[name] = hs
+	}
+	h := hs[key]
+	if h == nil {
+		h = &histogram{bounds: m.Buckets, counts: make([]uint64, len(m.Buckets))}
+		hs[key] = h
+	}
+	for i, b := range h.bounds {
+		if value <= b {
+			h.counts[i]++
+		}
+	}
+	h.count++
+	h.sum += value
+}
+
+// ServeHTTP writes every metric in the Prometheus text format
+func (m *PrometheusMetrics) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for _, name := range sortedKeys(m.counters) {
+		fmt.Fprintf(w, "# TYPE %s counter\n", name)
+		c := m.counters[name]
+		for _, key := range sortedKeys(c) {
+			fmt.Fprintf(w, "%s%s %s\n", name, braces(key), promFloat(c[key]))
+		}
+	}
+	for _, name := range sortedKeys(m.histograms) {
+		fmt.Fprintf(w, "# TYPE %s histogram\n", name)
+		hs := m.histograms[name]
+		for _, key := range sortedKeys(hs) {
+			h := hs[key]
+			for i, b := range h.bounds {
+				fmt.Fprintf(w, "%s_bucket%s %d\n", name, braces(joinLabels(key, `le="`+promFloat(b)+`"`)), h.counts[i])
+			}
+			fmt.Fprintf(w, "%s_bucket%s %d\n", name, braces(joinLabels(key, `le="+Inf"`)), h.count)
+			fmt.Fprintf(w, "%s_sum%s %s\n", name, braces(key), promFloat(h.sum))
+			fmt.Fprintf(w, "%s_count%s %d\n", name, braces(key), h.count)
+		}
+	}
+}
+
+// promLabels formats name, value pairs as name="value",...
+func promLabels(labels []string) string {
+	var parts []string
+	for i := 0; i+1 < len(labels); i += 2 {
+		v := strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`).Replace(labels[i+1])
+		parts = append(parts, labels[i]+`="`+v+`"`)
+	}
+	return strings.Join(parts, ",")
+}
+
+func joinLabels(a string, b string) string {
+	if a == "" {
+		return b
+	}
+	return a + "," + b
+}
+
+func braces(labels string) string {
+	if labels == "" {
+		return ""
+	}
+	return "{" + labels + "}"
+}
+
+func promFloat(v float64) string {
+	return strconv.FormatFloat(v, 'g', -1, 64)
+}
+
+func sortedKeys[V any](m map[string]V) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
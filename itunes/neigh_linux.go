@@ -0,0 +1,110 @@
+package itunes
+
+import "net"
+import "os"
+import "bufio"
+import "strings"
+import "syscall"
+import "encoding/binary"
+import "github.com/pkg/errors"
+
+const (
+	ndaDst    = 1
+	ndaLladdr = 2
+
+	nudIncomplete = 0x01
+	nudFailed     = 0x20
+)
+
+// neighbours returns the kernel neighbour table keyed by MAC address, from
+// netlink or /proc/net/arp if netlink is unavailable
+func neighbours() (map[string][]net.IPAddr, error) {
+	ret, err := netlinkNeighbours()
+	if err == nil {
+		return ret, nil
+	}
+	return procNeighbours()
+}
+
+func netlinkNeighbours() (map[string][]net.IPAddr, error) {
+	tab, err := syscall.NetlinkRIB(syscall.RTM_GETNEIGH, syscall.AF_UNSPEC)
+	if err != nil {
+		return nil, errors.Wrap(err, "Netlink")
+	}
+	msgs, err := syscall.ParseNetlinkMessage(tab)
+	if err != nil {
+		return nil, errors.Wrap(err, "Netlink")
+	}
+	zones := make(map[int]string)
+	if ifaces, err := net.Interfaces(); err == nil {
+		for _, i := range ifaces {
+			zones[i.Index] = i.Name
+		}
+	}
+	ret := make(map[string][]net.IPAddr)
+	for _, m := range msgs {
+		if m.Header.Type != syscall.RTM_NEWNEIGH || len(m.Data) < 12 {
+			continue
+		}
+		// struct ndmsg
+		ifindex := int(int32(binary.NativeEndian.Uint32(m.Data[4:])))
+		state := binary.NativeEndian.Uint16(m.Data[8:])
+		if state&(nudIncomplete|nudFailed) != 0 {
+			continue
+		}
+		var ip net.IP
+		var hw net.HardwareAddr
+		attrs := m.Data[12:]
+		for len(attrs) >= 4 {
+			l := int(binary.NativeEndian.Uint16(attrs[0:]))
+			t := binary.NativeEndian.Uint16(attrs[2:])
+			if l < 4 || l > len(attrs) {
+				break
+			}
+			switch t {
+			case ndaDst:
+				ip = net.IP(append([]byte(nil), attrs[4:l]...))
+			case ndaLladdr:
+				hw = net.HardwareAddr(append([]byte(nil), attrs[4:l]...))
+			}
+			l = (l + 3) &^ 3
+			if l > len(attrs) {
+				break
+			}
+			attrs = attrs[l:]
+		}
+		if ip == nil || len(hw) != 6 {
+			continue
+		}
+		a := net.IPAddr{IP: ip}
+		if ip.IsLinkLocalUnicast() && ip.To4() == nil {
+			a.Zone = zones[ifindex]
+		}
+		ret[hw.String()] = append(ret[hw.String()], a)
+	}
+	return ret, nil
+}
+
+func procNeighbours() (map[string][]net.IPAddr, error) {
+	f, err := os.Open("/proc/net/arp")
+	if err != nil {
+		return nil, errors.Wrap(err, "Unable to Read ARP Table")
+	}
+	defer f.Close()
+	ret := make(map[string][]net.IPAddr)
+	s := bufio.NewScanner(f)
+	s.Scan() // header
+	for s.Scan() {
+		fields := strings.Fields(s.Text())
+		if len(fields) < 4 || fields[2] == "0x0" {
+			continue
+		}
+		ip := net.ParseIP(fields[0])
+		hw, err := net.ParseMAC(fields[3])
+		if ip == nil || err != nil {
+			continue
+		}
+		ret[hw.String()] = append(ret[hw.String()], net.IPAddr{IP: ip})
+	}
+	return ret, nil
+}
@@ -0,0 +1,10 @@
+//go:build !linux
+
+package itunes
+
+import "net"
+import "github.com/pkg/errors"
+
+func neighbours() (map[string][]net.IPAddr, error) {
+	return nil, errors.New("Neighbour table not supported on this platform")
+}
@@ -0,0 +1,24 @@
+package itunes
+
+import "io"
+import "os"
+import "github.com/pkg/errors"
+
+// Option configures a Lockdown session, see Connect
+type Option func(*Lockdown)
+
+// WithKeyLog writes the TLS secrets of the session and every service it
+// starts to w in NSS key log format, so captures can be decrypted by
+// Wireshark
+func WithKeyLog(w io.Writer) Option {
+	return func(l *Lockdown) {
+		l.keylog = w
+	}
+}
+
+// OpenKeyLogFile opens fn for appending, for use with WithKeyLog. The caller
+// closes the file once every session using it has stopped.
+func OpenKeyLogFile(fn string) (*os.File, error) {
+	f, err := os.OpenFile(fn, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0600)
+	return f, errors.Wrap(err, "Unable to Open Key Log")
+}
@@ -1,10 +1,7 @@
 package itunes
 
-import "os"
-import "log"
-import "github.com/DHowett/go-plist"
-import "io/ioutil"
 import "net"
+import "github.com/pkg/errors"
 
 type PairRecord struct {
 	DeviceCertificate []byte
@@ -12,40 +9,50 @@ type PairRecord struct {
 	HostCertificate   []byte
 	HostID            string
 	HostPrivateKey    []byte
+	RootCertificate   []byte
 	RootPrivateKey    []byte
 	SystemBUID        string
 	WiFiMACAddress    string
 }
 
+// LoadPairs reads every pair record in the Lockdown directory and keys them
+// by Bonjour instance name. Unreadable records are logged and skipped.
 func LoadPairs() (ret map[string]PairRecord) {
 	ret = make(map[string]PairRecord)
-	//TODO: Determine file automatically
-	files := []string{
-		"Lockdown/02bf95695a8082259200385fca5a34ae00e80da7.plist",
-		"Lockdown/9f79ffa8d50044b0457eb1ad970a6ab81982449b.plist",
+	store, err := NewFilePairStore("Lockdown")
+	if err != nil {
+		logger().Warn("LoadPairs", "err", err)
 	}
-	for _, fn := range files {
-		file, err := os.Open(fn)
+	pairs, _ := store.List()
+	for UDID, v := range pairs {
+		instanceName, err := InstanceName(v)
 		if err != nil {
-			log.Fatal(err)
+			logger().Warn("LoadPairs", "udid", UDID, "err", err)
+			continue
 		}
-		buf, err := ioutil.ReadAll(file)
-		if err != nil {
-			log.Fatal(err)
-		}
-		var v PairRecord
-		_, err = plist.Unmarshal(buf, &v)
-		if err != nil {
-			log.Fatal(err)
-		}
-		hw, err := net.ParseMAC(v.WiFiMACAddress)
-		if err != nil {
-			log.Fatal(err)
-		}
-		IPbyte := []byte{0xfe, 0x80, 0, 0, 0, 0, 0, 0, hw[0] ^ 0x02, hw[1], hw[2], 0xff, 0xfe, hw[3], hw[4], hw[5]}
-		instanceName := hw.String() + "\\@" + net.IP(IPbyte).String()
 		ret[instanceName] = v
-		log.Println("Loaded Pair Record:", instanceName)
+		logger().Debug("Loaded Pair Record", "instance", instanceName)
 	}
 	return
 }
+
+// InstanceName returns the _apple-mobdev2._tcp Bonjour instance name the
+// paired device announces, MAC@link-local-address
+func InstanceName(pair PairRecord) (string, error) {
+	hw, err := net.ParseMAC(pair.WiFiMACAddress)
+	if err != nil {
+		return "", errors.Wrap(err, "Invalid WiFiMACAddress")
+	}
+	if len(hw) != 6 {
+		return "", errors.New("Invalid WiFiMACAddress: Not EUI-48")
+	}
+	return hw.String() + "\\@" + LinkLocalAddress(hw).String(), nil
+}
+
+// LinkLocalAddress returns the EUI-64 fe80:: address for an EUI-48 hw
+func LinkLocalAddress(hw net.HardwareAddr) net.IP {
+	if len(hw) != 6 {
+		return nil
+	}
+	return net.IP{0xfe, 0x80, 0, 0, 0, 0, 0, 0, hw[0] ^ 0x02, hw[1], hw[2], 0xff, 0xfe, hw[3], hw[4], hw[5]}
+}
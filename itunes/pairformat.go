@@ -0,0 +1,151 @@
+package itunes
+
+import "os"
+import "time"
+import "path/filepath"
+import "io/ioutil"
+import "encoding/json"
+import "encoding/pem"
+import "crypto/tls"
+import "crypto/x509"
+import "github.com/pkg/errors"
+import "github.com/DHowett/go-plist"
+
+// UnmarshalPairRecord decodes an iTunes/usbmuxd pair record. Both XML and
+// binary plists are accepted.
+func UnmarshalPairRecord(buf []byte) (PairRecord, error) {
+	var v PairRecord
+	_, err := plist.Unmarshal(buf, &v)
+	if err != nil {
+		return PairRecord{}, errors.Wrap(err, "UnmarshalPairRecord")
+	}
+	return v, nil
+}
+
+// MarshalPairRecord encodes pair as a plist. format is plist.XMLFormat or
+// plist.BinaryFormat.
+func MarshalPairRecord(pair PairRecord, format int) ([]byte, error) {
+	buf, err := plist.Marshal(pair, format)
+	return buf, errors.Wrap(err, "MarshalPairRecord")
+}
+
+// MarshalPairRecordJSON encodes pair as JSON. Certificates and keys are
+// base64 encoded.
+func MarshalPairRecordJSON(pair PairRecord) ([]byte, error) {
+	buf, err := json.Marshal(pair)
+	return buf, errors.Wrap(err, "MarshalPairRecordJSON")
+}
+
+// UnmarshalPairRecordJSON decodes the output of MarshalPairRecordJSON
+func UnmarshalPairRecordJSON(buf []byte) (PairRecord, error) {
+	var v PairRecord
+	err := json.Unmarshal(buf, &v)
+	return v, errors.Wrap(err, "UnmarshalPairRecordJSON")
+}
+
+type systemConfiguration struct {
+	SystemBUID string
+}
+
+// ReadSystemBUID reads SystemConfiguration.plist from a libimobiledevice
+// lockdown directory
+func ReadSystemBUID(dir string) (string, error) {
+	buf, err := ioutil.ReadFile(filepath.Join(dir, "SystemConfiguration.plist"))
+	if err != nil {
+		return "", errors.Wrap(err, "ReadSystemBUID")
+	}
+	var v systemConfiguration
+	_, err = plist.Unmarshal(buf, &v)
+	if err != nil {
+		return "", errors.Wrap(err, "ReadSystemBUID")
+	}
+	return v.SystemBUID, nil
+}
+
+// WriteSystemBUID writes SystemConfiguration.plist to a libimobiledevice
+// lockdown directory
+func WriteSystemBUID(dir string, SystemBUID string) error {
+	buf, err := plist.MarshalIndent(systemConfiguration{SystemBUID}, plist.XMLFormat, "\t")
+	if err != nil {
+		return errors.Wrap(err, "WriteSystemBUID")
+	}
+	return errors.Wrap(ioutil.WriteFile(filepath.Join(dir, "SystemConfiguration.plist"), buf, 0644), "WriteSystemBUID")
+}
+
+// ImportLibimobiledevice reads <UDID>.plist from a libimobiledevice lockdown
+// directory. Records without a SystemBUID take it from
+// SystemConfiguration.plist.
+func ImportLibimobiledevice(dir string, UDID string) (PairRecord, error) {
+	buf, err := ioutil.ReadFile(filepath.Join(dir, UDID+".plist"))
+	if err != nil {
+		return PairRecord{}, errors.Wrap(err, "ImportLibimobiledevice")
+	}
+	pair, err := UnmarshalPairRecord(buf)
+	if err != nil {
+		return PairRecord{}, err
+	}
+	if pair.SystemBUID == "" {
+		pair.SystemBUID, err = ReadSystemBUID(dir)
+		if err != nil {
+			return PairRecord{}, err
+		}
+	}
+	return pair, nil
+}
+
+// ExportLibimobiledevice writes pair to <UDID>.plist in a libimobiledevice
+// lockdown directory, creating SystemConfiguration.plist if it is missing
+func ExportLibimobiledevice(dir string, UDID string, pair PairRecord) error {
+	if _, err := os.Stat(filepath.Join(dir, "SystemConfiguration.plist")); os.IsNotExist(err) {
+		if err := WriteSystemBUID(dir, pair.SystemBUID); err != nil {
+			return err
+		}
+	}
+	return SavePairRecord(filepath.Join(dir, UDID+".plist"), pair)
+}
+
+// Validate checks the host certificate matches the host private key, the
+// root certificate matches the root private key when both are present, and
+// that every certificate is valid at now
+func (p PairRecord) Validate(now time.Time) error {
+	_, err := tls.X509KeyPair(p.HostCertificate, p.HostPrivateKey)
+	if err != nil {
+		return errors.Wrap(EKEYMISMATCH, "HostCertificate: "+err.Error())
+	}
+	if len(p.RootCertificate) != 0 && len(p.RootPrivateKey) != 0 {
+		_, err := tls.X509KeyPair(p.RootCertificate, p.RootPrivateKey)
+		if err != nil {
+			return errors.Wrap(EKEYMISMATCH, "RootCertificate: "+err.Error())
+		}
+	}
+	certs := []struct {
+		name string
+		pem  []byte
+	}{
+		{"HostCertificate", p.HostCertificate},
+		{"RootCertificate", p.RootCertificate},
+		{"DeviceCertificate", p.DeviceCertificate},
+	}
+	for _, c := range certs {
+		if len(c.pem) == 0 {
+			continue
+		}
+		cert, err := parseCertificate(c.pem)
+		if err != nil {
+			return errors.Wrap(err, c.name)
+		}
+		if now.Before(cert.NotBefore) || now.After(cert.NotAfter) {
+			return errors.Wrap(ECERTIFICATEEXPIRED, c.name)
+		}
+	}
+	return nil
+}
+
+// parseCertificate decodes a PEM or DER certificate
+func parseCertificate(buf []byte) (*x509.Certificate, error) {
+	if block, _ := pem.Decode(buf); block != nil {
+		buf = block.Bytes
+	}
+	cert, err := x509.ParseCertificate(buf)
+	return cert, errors.Wrap(err, "Invalid Certificate")
+}
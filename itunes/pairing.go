@@ -0,0 +1,231 @@
+package itunes
+
+import "net"
+import "time"
+import "crypto/rand"
+import "crypto/rsa"
+import "crypto/sha1"
+import "crypto/x509"
+import "encoding/pem"
+import "fmt"
+import "math/big"
+import "io/ioutil"
+import "github.com/pkg/errors"
+import "github.com/DHowett/go-plist"
+
+// PairPollInterval is how often Pair asks the device whether the user has
+// answered the Trust dialog
+var PairPollInterval = time.Second
+
+// Pair creates a new PairRecord and pairs it with the device at addr,
+// returning the device's UDID to save it under, see PairStore.Put.
+// If the device shows the Trust dialog Pair waits up to wait for the user to
+// accept it. An empty SystemBUID generates a new one.
+func Pair(addr net.IP, SystemBUID string, wait time.Duration, opts ...Option) (string, PairRecord, error) {
+	l, err := dialLockdown(addr, "", opts...)
+	if err != nil {
+		return "", PairRecord{}, err
+	}
+	defer l.c.Close()
+
+	var UDID string
+	err = l.GetValue("UniqueDeviceID", &UDID)
+	if err != nil {
+		return "", PairRecord{}, errors.Wrap(err, "Pair: Unable to Get UniqueDeviceID")
+	}
+
+	var pubkey []byte
+	err = l.GetValue("DevicePublicKey", &pubkey)
+	if err != nil {
+		return "", PairRecord{}, errors.Wrap(err, "Pair: Unable to Get DevicePublicKey")
+	}
+
+	if SystemBUID == "" {
+		SystemBUID, err = newUUID()
+		if err != nil {
+			return "", PairRecord{}, errors.Wrap(err, "Pair: Unable to Generate SystemBUID")
+		}
+	}
+	pair, err := NewPairRecord(pubkey, SystemBUID)
+	if err != nil {
+		return "", PairRecord{}, err
+	}
+
+	deadline := time.Now().Add(wait)
+	for {
+		var res lockdownPairResponse
+		err = l.pairRequest("Pair", pair, &lockdownPairingOptions{true}, &res)
+		if errors.Cause(err) == EPAIRINGDIALOGRESPONSEPENDING && time.Now().Before(deadline) {
+			l.log.Info("LOCKDOWN: Pair: Waiting for user to trust host")
+			time.Sleep(PairPollInterval)
+			continue
+		}
+		if err != nil {
+			return "", PairRecord{}, err
+		}
+		pair.EscrowBag = res.EscrowBag
+		break
+	}
+
+	var wifi string
+	if err := l.GetValue("WiFiAddress", &wifi); err == nil {
+		pair.WiFiMACAddress = wifi
+	}
+
+	l.log.Info("LOCKDOWN: Paired", "udid", UDID, "hostid", pair.HostID)
+	return UDID, pair, nil
+}
+
+// ValidatePair checks pair is still trusted by the device at addr
+func ValidatePair(addr net.IP, pair PairRecord, opts ...Option) error {
+	l, err := dialLockdown(addr, pair.WiFiMACAddress, opts...)
+	if err != nil {
+		return err
+	}
+	defer l.c.Close()
+	var res lockdownPairResponse
+	return l.pairRequest("ValidatePair", pair, nil, &res)
+}
+
+// Unpair removes pair from the device at addr
+func Unpair(addr net.IP, pair PairRecord, opts ...Option) error {
+	l, err := dialLockdown(addr, pair.WiFiMACAddress, opts...)
+	if err != nil {
+		return err
+	}
+	defer l.c.Close()
+	var res lockdownPairResponse
+	return l.pairRequest("Unpair", pair, nil, &res)
+}
+
+func (l *Lockdown) pairRequest(Request string, pair PairRecord, options *lockdownPairingOptions, res *lockdownPairResponse) error {
+	s := lockdownPairRequest{
+		PairRecord: lockdownPairRecord{
+			DeviceCertificate: pair.DeviceCertificate,
+			HostCertificate:   pair.HostCertificate,
+			RootCertificate:   pair.RootCertificate,
+			HostID:            pair.HostID,
+			SystemBUID:        pair.SystemBUID,
+		},
+		PairingOptions:  options,
+		ProtocolVersion: "2",
+		Request:         Request,
+	}
+	err := l.request(s, res)
+	if err != nil {
+		return errors.Wrap(err, Request+": Unable to Send Request")
+	}
+	return errors.Wrap(lockdownError(res.Error), Request)
+}
+
+// NewPairRecord generates root and host certificates and signs the device
+// public key. devicePublicKey is the PEM encoded DevicePublicKey value.
+func NewPairRecord(devicePublicKey []byte, SystemBUID string) (PairRecord, error) {
+	block, _ := pem.Decode(devicePublicKey)
+	if block == nil {
+		return PairRecord{}, errors.New("NewPairRecord: Invalid DevicePublicKey")
+	}
+	var devkey interface{}
+	var err error
+	switch block.Type {
+	case "RSA PUBLIC KEY":
+		devkey, err = x509.ParsePKCS1PublicKey(block.Bytes)
+	default:
+		devkey, err = x509.ParsePKIXPublicKey(block.Bytes)
+	}
+	if err != nil {
+		return PairRecord{}, errors.Wrap(err, "NewPairRecord: Invalid DevicePublicKey")
+	}
+
+	rootkey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		return PairRecord{}, errors.Wrap(err, "NewPairRecord: Unable to Generate Root Key")
+	}
+	hostkey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		return PairRecord{}, errors.Wrap(err, "NewPairRecord: Unable to Generate Host Key")
+	}
+
+	now := time.Now().Add(-time.Hour)
+	root := &x509.Certificate{
+		SerialNumber:          big.NewInt(0),
+		NotBefore:             now,
+		NotAfter:              now.AddDate(10, 0, 0),
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+		SignatureAlgorithm:    x509.SHA256WithRSA,
+	}
+	rootder, err := x509.CreateCertificate(rand.Reader, root, root, &rootkey.PublicKey, rootkey)
+	if err != nil {
+		return PairRecord{}, errors.Wrap(err, "NewPairRecord: Unable to Create Root Certificate")
+	}
+
+	leaf := func(pub interface{}) ([]byte, error) {
+		t := &x509.Certificate{
+			SerialNumber:          big.NewInt(0),
+			NotBefore:             now,
+			NotAfter:              now.AddDate(10, 0, 0),
+			BasicConstraintsValid: true,
+			IsCA:                  false,
+			KeyUsage:              x509.KeyUsageDigitalSignature | x509.KeyUsageKeyEncipherment,
+			SubjectKeyId:          subjectKeyID(pub),
+			SignatureAlgorithm:    x509.SHA256WithRSA,
+		}
+		return x509.CreateCertificate(rand.Reader, t, root, pub, rootkey)
+	}
+	hostder, err := leaf(&hostkey.PublicKey)
+	if err != nil {
+		return PairRecord{}, errors.Wrap(err, "NewPairRecord: Unable to Create Host Certificate")
+	}
+	devder, err := leaf(devkey)
+	if err != nil {
+		return PairRecord{}, errors.Wrap(err, "NewPairRecord: Unable to Create Device Certificate")
+	}
+	HostID, err := newUUID()
+	if err != nil {
+		return PairRecord{}, errors.Wrap(err, "NewPairRecord: Unable to Generate HostID")
+	}
+
+	return PairRecord{
+		DeviceCertificate: pemEncode("CERTIFICATE", devder),
+		HostCertificate:   pemEncode("CERTIFICATE", hostder),
+		HostID:            HostID,
+		HostPrivateKey:    pemEncode("RSA PRIVATE KEY", x509.MarshalPKCS1PrivateKey(hostkey)),
+		RootCertificate:   pemEncode("CERTIFICATE", rootder),
+		RootPrivateKey:    pemEncode("RSA PRIVATE KEY", x509.MarshalPKCS1PrivateKey(rootkey)),
+		SystemBUID:        SystemBUID,
+	}, nil
+}
+
+// SavePairRecord writes pair to fn as an XML plist, in the same format read
+// by LoadPairs
+func SavePairRecord(fn string, pair PairRecord) error {
+	buf, err := plist.MarshalIndent(pair, plist.XMLFormat, "\t")
+	if err != nil {
+		return errors.Wrap(err, "SavePairRecord: Unable to Marshal")
+	}
+	return errors.Wrap(ioutil.WriteFile(fn, buf, 0600), "SavePairRecord: Unable to Write")
+}
+
+func subjectKeyID(pub interface{}) []byte {
+	der, err := x509.MarshalPKIXPublicKey(pub)
+	if err != nil {
+		return nil
+	}
+	h := sha1.Sum(der)
+	return h[:]
+}
+
+func pemEncode(Type string, der []byte) []byte {
+	return pem.EncodeToMemory(&pem.Block{Type: Type, Bytes: der})
+}
+
+func newUUID() (string, error) {
+	var u [16]byte
+	if _, err := rand.Read(u[:]); err != nil {
+		return "", err
+	}
+	u[6] = u[6]&0x0f | 0x40
+	u[8] = u[8]&0x3f | 0x80
+	return fmt.Sprintf("%X-%X-%X-%X-%X", u[0:4], u[4:6], u[6:8], u[8:10], u[10:16]), nil
+}
@@ -0,0 +1,223 @@
+package itunes
+
+import "os"
+import "sync"
+import "strings"
+import "net"
+import "path/filepath"
+import "io/ioutil"
+import "time"
+import "github.com/pkg/errors"
+import "github.com/DHowett/go-plist"
+
+// PairStore holds PairRecords indexed by device UDID. Records returned are
+// the caller's own copies, which it may Wipe when done.
+type PairStore interface {
+	// Get returns the PairRecord for UDID
+	Get(UDID string) (PairRecord, error)
+	// ByWiFiMACAddress returns the UDID and PairRecord for a Wi-Fi MAC address
+	ByWiFiMACAddress(mac string) (string, PairRecord, error)
+	// ByHostID returns the UDID and PairRecord with HostID
+	ByHostID(HostID string) (string, PairRecord, error)
+	// List returns every PairRecord keyed by UDID
+	List() (map[string]PairRecord, error)
+	// Put adds or replaces the PairRecord for UDID
+	Put(UDID string, pair PairRecord) error
+	// Remove deletes the PairRecord for UDID
+	Remove(UDID string) error
+}
+
+// MalformedPairRecordError is returned by FilePairStore.Reload for files
+// that could not be read. Valid records are still loaded.
+type MalformedPairRecordError struct {
+	Files map[string]error
+}
+
+func (e *MalformedPairRecordError) Error() string {
+	var s []string
+	for fn, err := range e.Files {
+		s = append(s, fn+": "+err.Error())
+	}
+	return "Malformed Pair Records: " + strings.Join(s, ", ")
+}
+
+// FilePairStore is a PairStore backed by a directory of <UDID>.plist files,
+// such as /var/lib/lockdown or the iTunes Lockdown folder
+type FilePairStore struct {
+	dir   string
+	mu    sync.RWMutex
+	pairs map[string]PairRecord
+	mac   map[string]string
+	host  map[string]string
+}
+
+// NewFilePairStore scans dir. A MalformedPairRecordError is returned
+// alongside a usable store if some files could not be read.
+func NewFilePairStore(dir string) (*FilePairStore, error) {
+	s := &FilePairStore{dir: dir, pairs: make(map[string]PairRecord)}
+	return s, s.Reload()
+}
+
+// Reload rescans the directory
+func (s *FilePairStore) Reload() error {
+	entries, err := ioutil.ReadDir(s.dir)
+	if err != nil {
+		return errors.Wrap(err, "PairStore: Unable to Read Directory")
+	}
+	pairs := make(map[string]PairRecord)
+	malformed := make(map[string]error)
+	for _, e := range entries {
+		UDID, ok := udidFromFilename(e.Name())
+		if e.IsDir() || !ok {
+			continue
+		}
+		fn := filepath.Join(s.dir, e.Name())
+		pair, err := readPairRecord(fn)
+		if err != nil {
+			malformed[fn] = err
+			continue
+		}
+		pairs[UDID] = pair
+	}
+
+	s.mu.Lock()
+	s.pairs = pairs
+	s.reindex()
+	s.mu.Unlock()
+
+	if len(malformed) != 0 {
+		return &MalformedPairRecordError{malformed}
+	}
+	return nil
+}
+
+func (s *FilePairStore) Get(UDID string) (PairRecord, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	pair, ok := s.pairs[UDID]
+	if !ok {
+		return PairRecord{}, ENOPAIRRECORD
+	}
+	return pair.clone(), nil
+}
+
+func (s *FilePairStore) ByWiFiMACAddress(mac string) (string, PairRecord, error) {
+	hw, err := net.ParseMAC(mac)
+	if err != nil {
+		return "", PairRecord{}, errors.Wrap(err, "PairStore: Invalid MAC Address")
+	}
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	UDID, ok := s.mac[hw.String()]
+	if !ok {
+		return "", PairRecord{}, ENOPAIRRECORD
+	}
+	return UDID, s.pairs[UDID].clone(), nil
+}
+
+func (s *FilePairStore) ByHostID(HostID string) (string, PairRecord, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	UDID, ok := s.host[strings.ToUpper(HostID)]
+	if !ok {
+		return "", PairRecord{}, ENOPAIRRECORD
+	}
+	return UDID, s.pairs[UDID].clone(), nil
+}
+
+func (s *FilePairStore) List() (map[string]PairRecord, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	ret := make(map[string]PairRecord, len(s.pairs))
+	for k, v := range s.pairs {
+		ret[k] = v.clone()
+	}
+	return ret, nil
+}
+
+func (s *FilePairStore) Put(UDID string, pair PairRecord) error {
+	if UDID == "" || strings.ContainsAny(UDID, "/\\") {
+		return errors.New("PairStore: Invalid UDID")
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	fn := filepath.Join(s.dir, UDID+".plist")
+	if err := SavePairRecord(fn+".tmp", pair); err != nil {
+		return err
+	}
+	if err := os.Rename(fn+".tmp", fn); err != nil {
+		os.Remove(fn + ".tmp")
+		return errors.Wrap(err, "PairStore: Unable to Rename")
+	}
+	s.pairs[UDID] = pair.clone()
+	s.reindex()
+	return nil
+}
+
+func (s *FilePairStore) Remove(UDID string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, ok := s.pairs[UDID]; !ok {
+		return ENOPAIRRECORD
+	}
+	err := os.Remove(filepath.Join(s.dir, UDID+".plist"))
+	if err != nil && !os.IsNotExist(err) {
+		return errors.Wrap(err, "PairStore: Unable to Remove")
+	}
+	delete(s.pairs, UDID)
+	s.reindex()
+	return nil
+}
+
+// reindex rebuilds the MAC and HostID indexes. s.mu must be held.
+func (s *FilePairStore) reindex() {
+	s.mac = make(map[string]string)
+	s.host = make(map[string]string)
+	for UDID, pair := range s.pairs {
+		if hw, err := net.ParseMAC(pair.WiFiMACAddress); err == nil {
+			s.mac[hw.String()] = UDID
+		}
+		if pair.HostID != "" {
+			s.host[strings.ToUpper(pair.HostID)] = UDID
+		}
+	}
+}
+
+// udidFromFilename returns the UDID for a pair record file name. Other
+// plists in the directory such as SystemConfiguration.plist are skipped.
+func udidFromFilename(name string) (string, bool) {
+	if !strings.HasSuffix(name, ".plist") || name == "SystemConfiguration.plist" {
+		return "", false
+	}
+	return strings.TrimSuffix(name, ".plist"), true
+}
+
+func readPairRecord(fn string) (PairRecord, error) {
+	buf, err := ioutil.ReadFile(fn)
+	if err != nil {
+		return PairRecord{}, err
+	}
+	var v PairRecord
+	_, err = plist.Unmarshal(buf, &v)
+	if err != nil {
+		return PairRecord{}, err
+	}
+	if len(v.HostCertificate) == 0 || len(v.HostPrivateKey) == 0 || v.HostID == "" {
+		return PairRecord{}, errors.New("Missing HostCertificate, HostPrivateKey or HostID")
+	}
+	if err := v.Validate(time.Now()); err != nil {
+		return PairRecord{}, err
+	}
+	return v, nil
+}
+
+// clone copies p so wiping either does not affect the other
+func (p PairRecord) clone() PairRecord {
+	c := p
+	for _, b := range []*[]byte{&c.DeviceCertificate, &c.EscrowBag, &c.HostCertificate, &c.HostPrivateKey, &c.RootCertificate, &c.RootPrivateKey} {
+		if *b != nil {
+			*b = append([]byte(nil), *b...)
+		}
+	}
+	return c
+}
@@ -0,0 +1,144 @@
+package itunes
+
+import "context"
+import "net"
+import "sync"
+
+// SessionPool shares one Lockdown session, and its heartbeat, between the
+// service clients of each device. Sessions are keyed by the DeviceCertificate
+// of the PairRecord and stopped when their last reference is released. A
+// session keeps the Options of the call that connected it, Options passed
+// while it is running are ignored.
+type SessionPool struct {
+	mu       sync.Mutex
+	sessions map[string]*poolEntry
+}
+
+type poolEntry struct {
+	mu   sync.Mutex // held while connecting
+	l    *Lockdown
+	refs int
+}
+
+// PooledSession is a reference to a Lockdown shared through a SessionPool.
+// Release it when done. StopSession and Close only release the reference,
+// the session is stopped once every holder has released it.
+type PooledSession struct {
+	*Lockdown
+	pool  *SessionPool
+	key   string
+	entry *poolEntry
+	once  sync.Once
+}
+
+func NewSessionPool() *SessionPool {
+	return &SessionPool{sessions: make(map[string]*poolEntry)}
+}
+
+// Acquire returns the session for pair, connecting with Connect if there is
+// none or the previous one has stopped. opts only apply when a session is
+// connected, they are ignored while the session for pair is running.
+func (p *SessionPool) Acquire(addr net.IP, pair PairRecord, opts ...Option) (*PooledSession, error) {
+	key := string(pair.DeviceCertificate)
+	p.mu.Lock()
+	e := p.sessions[key]
+	if e == nil {
+		e = &poolEntry{}
+		p.sessions[key] = e
+	}
+	e.refs++
+	p.mu.Unlock()
+
+	e.mu.Lock()
+	if e.l == nil || e.l.IsGracefullyShuttingdown() {
+		l, err := Connect(addr, pair, opts...)
+		if err != nil {
+			e.mu.Unlock()
+			p.release(key, e)
+			return nil, err
+		}
+		e.l = l
+	}
+	l := e.l
+	e.mu.Unlock()
+	return &PooledSession{Lockdown: l, pool: p, key: key, entry: e}, nil
+}
+
+// Release drops the reference, stopping the session if it was the last one.
+// Further calls do nothing.
+func (s *PooledSession) Release() {
+	s.once.Do(func() { s.pool.release(s.key, s.entry) })
+}
+
+// StopSession is Release
+func (s *PooledSession) StopSession() {
+	s.Release()
+}
+
+// Close is Release, ctx is not used
+func (s *PooledSession) Close(ctx context.Context) error {
+	s.Release()
+	return nil
+}
+
+func (p *SessionPool) release(key string, e *poolEntry) {
+	p.mu.Lock()
+	e.refs--
+	last := e.refs == 0
+	if last && p.sessions[key] == e {
+		delete(p.sessions, key)
+	}
+	p.mu.Unlock()
+	if !last {
+		return
+	}
+	e.mu.Lock()
+	l := e.l
+	e.mu.Unlock()
+	if l != nil && !l.IsGracefullyShuttingdown() {
+		l.StopSession()
+	}
+}
+
+// StartService starts Service on the pooled session for pair. The session is
+// released when the returned connection is closed.
+func (p *SessionPool) StartService(addr net.IP, pair PairRecord, Service string, opts ...Option) (net.Conn, error) {
+	s, err := p.Acquire(addr, pair, opts...)
+	if err != nil {
+		return nil, err
+	}
+	c, err := s.StartService(Service)
+	if err != nil {
+		s.Release()
+		return nil, err
+	}
+	return &pooledConn{Conn: c, s: s}, nil
+}
+
+// StartAFC is StartAFC on the pooled session for pair. Closing the AfcConn
+// releases the session.
+func (p *SessionPool) StartAFC(addr net.IP, pair PairRecord, opts ...Option) (*AfcConn, error) {
+	s, err := p.Acquire(addr, pair, opts...)
+	if err != nil {
+		return nil, err
+	}
+	a, err := StartAFC(s.Lockdown)
+	if err != nil {
+		s.Release()
+		return nil, err
+	}
+	a.Conn = &pooledConn{Conn: a.Conn, s: s}
+	return a, nil
+}
+
+// pooledConn releases its session reference when closed
+type pooledConn struct {
+	net.Conn
+	s *PooledSession
+}
+
+func (c *pooledConn) Close() error {
+	err := c.Conn.Close()
+	c.s.Release()
+	return err
+}
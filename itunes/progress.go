@@ -0,0 +1,149 @@
+package itunes
+
+import "sync"
+import "time"
+
+// ProgressInterval is the least time between progress updates for a transfer.
+// The first and final updates are always sent.
+var ProgressInterval = 250 * time.Millisecond
+
+// TransferStatus describes a transfer in progress. File is empty for the
+// totals of a batch. Files is the size of the batch a file belongs to,
+// FilesDone is only set for the batch totals. Total, and
+// so ETA, are -1 when the size is unknown. Rate is in bytes per second
+// averaged over the transfer.
+type TransferStatus struct {
+	File      string
+	Done      int64
+	Total     int64
+	Rate      float64
+	ETA       time.Duration
+	Elapsed   time.Duration
+	Finished  bool
+	Files     int
+	FilesDone int
+}
+
+// Progress receives transfer updates, see AfcRetryConn.SetProgress. Files in
+// a batch report their own updates as well as the batch totals.
+type Progress interface {
+	Progress(TransferStatus)
+}
+
+// ProgressFunc adapts a func to Progress
+type ProgressFunc func(TransferStatus)
+
+func (f ProgressFunc) Progress(s TransferStatus) {
+	f(s)
+}
+
+// progressMeter tracks one file or one batch. A nil meter does nothing so
+// callers need not check whether progress was asked for.
+type progressMeter struct {
+	mu     sync.Mutex
+	p      Progress
+	s      TransferStatus
+	start  time.Time
+	last   time.Time
+	parent *progressMeter
+}
+
+func newProgressMeter(p Progress, File string, Total int64) *progressMeter {
+	return startMeter(p, TransferStatus{File: File, Total: Total}, nil)
+}
+
+// newBatchMeter tracks Files files totalling Total bytes
+func newBatchMeter(p Progress, Files int, Total int64) *progressMeter {
+	return startMeter(p, TransferStatus{Total: Total, Files: Files}, nil)
+}
+
+// file starts a meter for a file of this batch
+func (m *progressMeter) file(File string, Total int64) *progressMeter {
+	if m == nil {
+		return nil
+	}
+	m.mu.Lock()
+	Files := m.s.Files
+	m.mu.Unlock()
+	return startMeter(m.p, TransferStatus{File: File, Total: Total, Files: Files}, m)
+}
+
+// startMeter sends the first report for s
+func startMeter(p Progress, s TransferStatus, parent *progressMeter) *progressMeter {
+	if p == nil {
+		return nil
+	}
+	m := &progressMeter{p: p, s: s, start: time.Now(), parent: parent}
+	m.s.ETA = -1
+	m.report(true)
+	return m
+}
+
+func (m *progressMeter) add(n int) {
+	if m == nil || n == 0 {
+		return
+	}
+	m.mu.Lock()
+	m.s.Done += int64(n)
+	m.report(false)
+	m.mu.Unlock()
+	m.parent.add(n)
+}
+
+// restart discards progress after a transfer had to start again
+func (m *progressMeter) restart() {
+	if m == nil {
+		return
+	}
+	m.mu.Lock()
+	n := m.s.Done
+	m.s.Done = 0
+	m.mu.Unlock()
+	m.parent.sub(n)
+}
+
+func (m *progressMeter) sub(n int64) {
+	if m == nil {
+		return
+	}
+	m.mu.Lock()
+	m.s.Done -= n
+	m.mu.Unlock()
+}
+
+func (m *progressMeter) finish() {
+	if m == nil {
+		return
+	}
+	m.mu.Lock()
+	m.s.Finished = true
+	if m.s.Total < 0 {
+		m.s.Total = m.s.Done
+	}
+	m.report(true)
+	m.mu.Unlock()
+	if m.parent != nil {
+		m.parent.mu.Lock()
+		m.parent.s.FilesDone++
+		m.parent.report(true)
+		m.parent.mu.Unlock()
+	}
+}
+
+// report sends the status if ProgressInterval has passed. m.mu must be held.
+func (m *progressMeter) report(force bool) {
+	now := time.Now()
+	if !force && now.Sub(m.last) < ProgressInterval {
+		return
+	}
+	m.last = now
+	m.s.Elapsed = now.Sub(m.start)
+	if secs := m.s.Elapsed.Seconds(); secs > 0 {
+		m.s.Rate = float64(m.s.Done) / secs
+	}
+	m.s.ETA = -1
+	if m.s.Total >= 0 && m.s.Rate > 0 {
+		m.s.ETA = time.Duration(float64(m.s.Total-m.s.Done) / m.s.Rate * float64(time.Second))
+	}
+	m.p.Progress(m.s)
+}
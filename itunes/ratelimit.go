@@ -0,0 +1,157 @@
+package itunes
+
+import "context"
+import "sync"
+import "time"
+
+// Priority orders transfers waiting on a RateLimiter. Waiters of a higher
+// priority are always served first, waiters of the same priority in turn.
+type Priority int
+
+const (
+	PriorityBackground Priority = iota
+	PriorityInteractive
+	numPriorities
+)
+
+// RateLimiter is a token bucket of bytes shared fairly between the transfers
+// waiting on it. One RateLimiter given to the sessions of several devices,
+// see WithBandwidth, limits their combined bandwidth.
+type RateLimiter struct {
+	mu     sync.Mutex
+	rate   float64
+	burst  float64
+	tokens float64
+	last   time.Time
+	queues [numPriorities][]*rateWaiter
+	timer  *time.Timer
+}
+
+type rateWaiter struct {
+	n     float64
+	ready chan struct{}
+}
+
+// NewRateLimiter allows bytesPerSecond with bursts of up to burst bytes. A
+// burst below one AFC request still lets each request through, the
+// following ones wait for the deficit. Zero bytesPerSecond is unlimited.
+func NewRateLimiter(bytesPerSecond int64, burst int64) *RateLimiter {
+	r := &RateLimiter{burst: float64(burst), tokens: float64(burst), last: time.Now()}
+	r.SetRate(bytesPerSecond)
+	return r
+}
+
+// SetRate changes the rate, zero removes the limit
+func (r *RateLimiter) SetRate(bytesPerSecond int64) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.refill(time.Now())
+	r.rate = float64(bytesPerSecond)
+	r.dispatch()
+}
+
+// Wait blocks until n bytes may be transferred at priority p, or ctx is done
+func (r *RateLimiter) Wait(ctx context.Context, p Priority, n int) error {
+	if r == nil || n <= 0 {
+		return nil
+	}
+	if p < 0 {
+		p = 0
+	} else if p >= numPriorities {
+		p = numPriorities - 1
+	}
+	w := &rateWaiter{n: float64(n), ready: make(chan struct{})}
+	r.mu.Lock()
+	r.queues[p] = append(r.queues[p], w)
+	r.dispatch()
+	r.mu.Unlock()
+
+	select {
+	case <-w.ready:
+		return nil
+	case <-ctx.Done():
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	select {
+	case <-w.ready:
+		return nil
+	default:
+	}
+	q := r.queues[p]
+	for i := range q {
+		if q[i] == w {
+			r.queues[p] = append(q[:i:i], q[i+1:]...)
+			break
+		}
+	}
+	r.dispatch()
+	return ctx.Err()
+}
+
+// refill adds the tokens earned since last. r.mu must be held.
+func (r *RateLimiter) refill(now time.Time) {
+	if r.rate > 0 {
+		r.tokens += now.Sub(r.last).Seconds() * r.rate
+		if r.tokens > r.burst {
+			r.tokens = r.burst
+		}
+	}
+	r.last = now
+}
+
+// dispatch releases waiters in priority order while tokens last and arms a
+// timer for the next one. r.mu must be held.
+func (r *RateLimiter) dispatch() {
+	r.refill(time.Now())
+	for {
+		p := numPriorities - 1
+		for p >= 0 && len(r.queues[p]) == 0 {
+			p--
+		}
+		if p < 0 {
+			return
+		}
+		w := r.queues[p][0]
+		need := w.n
+		if need > r.burst {
+			need = r.burst
+		}
+		if r.rate > 0 && r.tokens < need {
+			wait := time.Duration((need - r.tokens) / r.rate * float64(time.Second))
+			if r.timer == nil {
+				r.timer = time.AfterFunc(wait, r.wake)
+			} else {
+				r.timer.Reset(wait)
+			}
+			return
+		}
+		if r.rate > 0 {
+			r.tokens -= w.n
+		}
+		r.queues[p] = r.queues[p][1:]
+		close(w.ready)
+	}
+}
+
+func (r *RateLimiter) wake() {
+	r.mu.Lock()
+	r.dispatch()
+	r.mu.Unlock()
+}
+
+// WithRateLimit limits each AFC connection of the session to bytesPerSecond
+func WithRateLimit(bytesPerSecond int64) Option {
+	return func(l *Lockdown) {
+		l.afcRate = bytesPerSecond
+	}
+}
+
+// WithBandwidth makes AFC connections of the session share r at priority p.
+// Pass the same r to every device to limit the total.
+func WithBandwidth(r *RateLimiter, p Priority) Option {
+	return func(l *Lockdown) {
+		l.bandwidth = r
+		l.priority = p
+	}
+}
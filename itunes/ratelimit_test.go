@@ -0,0 +1,157 @@
+package itunes
+
+import "context"
+import "errors"
+import "sync"
+import "testing"
+import "time"
+
+// waitQueued waits until n waiters are queued at priority p
+func waitQueued(t *testing.T, r *RateLimiter, p Priority, n int) {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		r.mu.Lock()
+		queued := len(r.queues[p])
+		r.mu.Unlock()
+		if queued == n {
+			return
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("%d waiters queued at priority %d, want %d", queued, p, n)
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+func TestRateLimiterThroughput(t *testing.T) {
+	const rate, burst, chunk, total = 100 << 10, 10 << 10, 5 << 10, 60 << 10
+	r := NewRateLimiter(rate, burst)
+	start := time.Now()
+	for sent := 0; sent < total; sent += chunk {
+		if err := r.Wait(context.Background(), PriorityBackground, chunk); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// The burst goes through at once, the rest at rate
+	want := time.Duration(float64(total-burst) / rate * float64(time.Second))
+	if d := time.Since(start); d < want*9/10 || d > want*3 {
+		t.Errorf("%d bytes took %v, want about %v", total, d, want)
+	}
+}
+
+func TestRateLimiterUnlimited(t *testing.T) {
+	r := NewRateLimiter(0, 0)
+	start := time.Now()
+	for i := 0; i < 1000; i++ {
+		if err := r.Wait(context.Background(), PriorityBackground, afcChunk); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if d := time.Since(start); d > time.Second {
+		t.Errorf("unlimited waits took %v", d)
+	}
+}
+
+func TestRateLimiterPriority(t *testing.T) {
+	r := NewRateLimiter(1000, 100)
+	// Empty the bucket so the next waiters queue
+	if err := r.Wait(context.Background(), PriorityBackground, 100); err != nil {
+		t.Fatal(err)
+	}
+
+	order := make(chan Priority, 3)
+	wait := func(p Priority) {
+		if err := r.Wait(context.Background(), p, 100); err != nil {
+			t.Error(err)
+		}
+		order <- p
+	}
+	go wait(PriorityBackground)
+	waitQueued(t, r, PriorityBackground, 1)
+	go wait(PriorityBackground)
+	waitQueued(t, r, PriorityBackground, 2)
+	go wait(PriorityInteractive)
+	waitQueued(t, r, PriorityInteractive, 1)
+
+	want := []Priority{PriorityInteractive, PriorityBackground, PriorityBackground}
+	for i, w := range want {
+		select {
+		case p := <-order:
+			if p != w {
+				t.Fatalf("waiter %d had priority %d, want %d", i, p, w)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatalf("waiter %d not released", i)
+		}
+	}
+}
+
+func TestRateLimiterFair(t *testing.T) {
+	r := NewRateLimiter(20000, 1000)
+	stop := make(chan struct{})
+	var counts [2]int
+	var wg sync.WaitGroup
+	for i := range counts {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			for {
+				select {
+				case <-stop:
+					return
+				default:
+				}
+				if err := r.Wait(context.Background(), PriorityBackground, 1000); err != nil {
+					t.Error(err)
+					return
+				}
+				counts[i]++
+			}
+		}(i)
+	}
+	time.Sleep(300 * time.Millisecond)
+	close(stop)
+	wg.Wait()
+
+	// Waiters of the same priority take turns, one may have had the burst
+	// and the next token before the other queued
+	if d := counts[0] - counts[1]; d < -2 || d > 2 || counts[0] < 2 {
+		t.Errorf("transfers served %d and %d times", counts[0], counts[1])
+	}
+}
+
+func TestRateLimiterCancel(t *testing.T) {
+	r := NewRateLimiter(1, 10)
+	if err := r.Wait(context.Background(), PriorityBackground, 10); err != nil {
+		t.Fatal(err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error, 1)
+	go func() { done <- r.Wait(ctx, PriorityInteractive, 10) }()
+	waitQueued(t, r, PriorityInteractive, 1)
+	cancel()
+	select {
+	case err := <-done:
+		if !errors.Is(err, context.Canceled) {
+			t.Fatalf("Wait returned %v, want context.Canceled", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("cancelled Wait did not return")
+	}
+	waitQueued(t, r, PriorityInteractive, 0)
+
+	// Raising the rate releases a waiter queued behind the cancelled one
+	go func() { done <- r.Wait(context.Background(), PriorityBackground, 10) }()
+	waitQueued(t, r, PriorityBackground, 1)
+	r.SetRate(1 << 20)
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Fatal(err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("waiter not released after SetRate")
+	}
+}
@@ -0,0 +1,109 @@
+package itunes
+
+import "net"
+import "sync"
+import "github.com/pkg/errors"
+
+// Resolver finds the current addresses of a device from its Wi-Fi MAC
+// address. Connect uses it when called without an address.
+type Resolver interface {
+	Resolve(mac string) ([]net.IPAddr, error)
+}
+
+// WithResolver sets the Resolver used when Connect is given no address
+func WithResolver(r Resolver) Option {
+	return func(l *Lockdown) {
+		l.resolver = r
+	}
+}
+
+// DefaultResolver is used by Connect when no Resolver is given
+var DefaultResolver = NewAddressResolver()
+
+// AddressResolver looks a MAC address up in, in order, a static map,
+// addresses learnt from Bonjour, the kernel ARP/NDP neighbour tables and
+// finally the EUI-64 link-local address derived from the MAC.
+type AddressResolver struct {
+	mu     sync.RWMutex
+	static map[string][]net.IPAddr
+	mdns   map[string][]net.IPAddr
+}
+
+func NewAddressResolver() *AddressResolver {
+	return &AddressResolver{
+		static: make(map[string][]net.IPAddr),
+		mdns:   make(map[string][]net.IPAddr),
+	}
+}
+
+// SetStatic fixes the addresses of mac. No addresses removes the entry.
+func (r *AddressResolver) SetStatic(mac string, addrs ...net.IPAddr) error {
+	hw, err := net.ParseMAC(mac)
+	if err != nil {
+		return errors.Wrap(err, "Resolver: Invalid MAC Address")
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if len(addrs) == 0 {
+		delete(r.static, hw.String())
+	} else {
+		r.static[hw.String()] = addrs
+	}
+	return nil
+}
+
+// Observe records the addresses in a BonjourEvent
+func (r *AddressResolver) Observe(e BonjourEvent) {
+	if e.MAC == nil {
+		return
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if !e.Appeared {
+		delete(r.mdns, e.MAC.String())
+		return
+	}
+	r.mdns[e.MAC.String()] = append([]net.IPAddr(nil), e.Addrs...)
+}
+
+// WatchBonjour calls Observe for every event until events is closed
+func (r *AddressResolver) WatchBonjour(events <-chan BonjourEvent) {
+	go func() {
+		for e := range events {
+			r.Observe(e)
+		}
+	}()
+}
+
+func (r *AddressResolver) Resolve(mac string) ([]net.IPAddr, error) {
+	hw, err := net.ParseMAC(mac)
+	if err != nil {
+		return nil, errors.Wrap(err, "Resolver: Invalid MAC Address")
+	}
+	var ret []net.IPAddr
+	r.mu.RLock()
+	ret = append(ret, r.static[hw.String()]...)
+	ret = append(ret, r.mdns[hw.String()]...)
+	r.mu.RUnlock()
+
+	if n, err := neighbours(); err == nil {
+		ret = append(ret, n[hw.String()]...)
+	}
+	if ll := LinkLocalAddress(hw); ll != nil {
+		ret = append(ret, net.IPAddr{IP: ll})
+	}
+	return dedupAddrs(ret), nil
+}
+
+func dedupAddrs(addrs []net.IPAddr) []net.IPAddr {
+	seen := make(map[string]bool)
+	var ret []net.IPAddr
+	for _, a := range addrs {
+		if seen[a.String()] {
+			continue
+		}
+		seen[a.String()] = true
+		ret = append(ret, a)
+	}
+	return ret
+}
@@ -1,83 +1,276 @@
 package itunes
 
-import "log"
 import "time"
 import "net"
 import "io"
-import "io/ioutil"
+import "os"
+import "bytes"
+import "path/filepath"
+import "sync"
+import "sync/atomic"
+import "context"
+import "errors"
 
 type afcpair struct {
-	a *AfcConn
-	l *Lockdown
+	a    *AfcConn
+	stop func(context.Context) error
 }
 
 type AfcRetryConn struct {
-	inner   *AfcConn
-	l       *Lockdown
-	n       chan afcpair
-	handles map[string]uint64
+	// mu guards swapping the connection against Close and Give
+	mu        sync.Mutex
+	inner     *AfcConn
+	stop      func(context.Context) error
+	closed    chan struct{}
+	closeOnce sync.Once
+	n         chan afcpair
+	handles   map[string]uint64
+	unwatch   func()
+	// assertion is held while transfers counts any in progress, see
+	// WithPowerAssertion
+	assertion *PowerAssertion
+	transfers int
+	// sleeping is set by the heartbeat when the device said SleepyTime
+	sleeping int32
+	progress Progress
+	priority *Priority
 }
 
-func NewRetryAfc(i net.IP, p PairRecord) (*AfcRetryConn, error) {
-	l, err := Connect(i, p)
-	if err != nil {
-		log.Println("ERR: ", err)
-		return nil, err
+// NewRetryAfc connects to i, or to the address resolved from
+// p.WiFiMACAddress when i is nil
+func NewRetryAfc(i net.IP, p PairRecord, opts ...Option) (*AfcRetryConn, error) {
+	return newRetryAfc(sessionAFC(func() (*Lockdown, error) { return Connect(i, p, opts...) }))
+}
+
+// NewRetryAfcFromStore is NewRetryAfc using the PairRecord for UDID in store
+func NewRetryAfcFromStore(i net.IP, store PairStore, UDID string, opts ...Option) (*AfcRetryConn, error) {
+	return newRetryAfc(sessionAFC(func() (*Lockdown, error) { return ConnectFromStore(i, store, UDID, opts...) }))
+}
+
+// NewRetryAfcFromPool is NewRetryAfc sharing the session for p in pool
+func NewRetryAfcFromPool(pool *SessionPool, i net.IP, p PairRecord, opts ...Option) (*AfcRetryConn, error) {
+	return newRetryAfc(pooledAFC(pool, i, p, opts...))
+}
+
+// afcStarter starts AFC and returns a func stopping the session it used
+type afcStarter func() (*AfcConn, func(context.Context) error, error)
+
+func sessionAFC(connect func() (*Lockdown, error)) afcStarter {
+	return func() (*AfcConn, func(context.Context) error, error) {
+		l, err := connect()
+		if err != nil {
+			return nil, nil, err
+		}
+		a, err := StartAFC(l)
+		if err != nil {
+			l.StopSession()
+			return nil, nil, err
+		}
+		return a, l.Close, nil
 	}
-	a, err := StartAFC(l)
+}
+
+// pooledAFC starts AFC on a pooled session, which is released by closing
+// the AfcConn rather than stopped
+func pooledAFC(pool *SessionPool, i net.IP, p PairRecord, opts ...Option) afcStarter {
+	return func() (*AfcConn, func(context.Context) error, error) {
+		a, err := pool.StartAFC(i, p, opts...)
+		return a, func(context.Context) error { return nil }, err
+	}
+}
+
+func newRetryAfc(start afcStarter) (*AfcRetryConn, error) {
+	a, stop, err := start()
 	if err != nil {
-		log.Println("ERR: ", err)
-		l.StopSession()
+		logger().Debug("RETRYAFC: Connect", "err", err)
 		return nil, err
 	}
 
-	return &AfcRetryConn{
+	afc := &AfcRetryConn{
 		inner:   a,
-		l:       l,
+		stop:    stop,
+		closed:  make(chan struct{}),
 		n:       make(chan afcpair),
 		handles: make(map[string]uint64),
-	}, nil
+	}
+	afc.watch()
+	return afc, nil
 }
 
-func (afc *AfcRetryConn) Give(i net.IP, p PairRecord) {
-	if afc.inner == nil {
-		l, err := Connect(i, p)
-		if err != nil {
-			log.Println("ERR: ", err)
-			return
-		}
-		a, err := StartAFC(l)
-		if err != nil {
-			log.Println("ERR: ", err)
-			l.StopSession()
-			return
+// watch follows the heartbeat of the current connection so a device going
+// to sleep pauses requests until Give supplies a new connection. afc.mu must
+// be held.
+func (afc *AfcRetryConn) watch() {
+	atomic.StoreInt32(&afc.sleeping, 0)
+	if afc.priority != nil {
+		afc.inner.SetPriority(*afc.priority)
+	}
+	if afc.transfers > 0 {
+		afc.assert()
+	}
+	afc.unwatch = afc.inner.l.OnHeartbeat(func(e HeartbeatEvent) {
+		switch e.Type {
+		case HeartbeatSleepyTime:
+			atomic.StoreInt32(&afc.sleeping, 1)
+		case HeartbeatMarco:
+			atomic.StoreInt32(&afc.sleeping, 0)
 		}
-		select {
-		case afc.n <- afcpair{a, l}:
-			return
-		case <-time.After(5 * time.Second):
-			log.Println("RETRYAFC: GIVE TIMEOUT")
+	})
+}
+
+// assert creates the power assertion asked for by WithPowerAssertion on the
+// current connection. A failure is logged, the transfer goes ahead without.
+// afc.mu must be held.
+func (afc *AfcRetryConn) assert() {
+	o := afc.inner.l.assertion
+	if o == nil || afc.assertion != nil {
+		return
+	}
+	a, err := afc.inner.l.CreatePowerAssertion(o.Type, "imobile AFC", o.Timeout)
+	if err != nil {
+		afc.inner.log.Warn("RETRYAFC: PowerAssertion", "err", err)
+		return
+	}
+	afc.assertion = a
+}
+
+// transfer marks a transfer in progress, holding the power assertion until
+// the returned func is called
+func (afc *AfcRetryConn) transfer() func() {
+	afc.mu.Lock()
+	defer afc.mu.Unlock()
+	afc.transfers++
+	if afc.unwatch != nil {
+		afc.assert()
+	}
+	return func() {
+		afc.mu.Lock()
+		defer afc.mu.Unlock()
+		afc.transfers--
+		if afc.transfers == 0 && afc.assertion != nil {
+			afc.assertion.Release()
+			afc.assertion = nil
 		}
-		a.Close()
-		l.StopSession()
 	}
 }
 
+// SetPriority changes the priority of transfers on the shared RateLimiter,
+// including after reconnects
+func (afc *AfcRetryConn) SetPriority(p Priority) {
+	afc.mu.Lock()
+	defer afc.mu.Unlock()
+	afc.priority = &p
+	afc.inner.SetPriority(p)
+}
+
+// Sleeping reports whether the device went to sleep and the connection is
+// waiting for Give
+func (afc *AfcRetryConn) Sleeping() bool {
+	return atomic.LoadInt32(&afc.sleeping) != 0
+}
+
+// Give supplies a new connection after a disconnect. A nil i resolves the
+// device from p.WiFiMACAddress.
+func (afc *AfcRetryConn) Give(i net.IP, p PairRecord, opts ...Option) {
+	afc.give(sessionAFC(func() (*Lockdown, error) { return Connect(i, p, opts...) }))
+}
+
+// GiveFromStore is Give using the PairRecord for UDID in store
+func (afc *AfcRetryConn) GiveFromStore(i net.IP, store PairStore, UDID string, opts ...Option) {
+	afc.give(sessionAFC(func() (*Lockdown, error) { return ConnectFromStore(i, store, UDID, opts...) }))
+}
+
+// GiveFromPool is Give sharing the session for p in pool
+func (afc *AfcRetryConn) GiveFromPool(pool *SessionPool, i net.IP, p PairRecord, opts ...Option) {
+	afc.give(pooledAFC(pool, i, p, opts...))
+}
+
+func (afc *AfcRetryConn) give(start afcStarter) {
+	afc.mu.Lock()
+	connected := afc.unwatch != nil
+	afc.mu.Unlock()
+	if connected {
+		return
+	}
+	a, stop, err := start()
+	if err != nil {
+		logger().Warn("RETRYAFC: Give", "err", err)
+		return
+	}
+	select {
+	case afc.n <- afcpair{a, stop}:
+		return
+	case <-time.After(5 * time.Second):
+		a.log.Warn("RETRYAFC: GIVE TIMEOUT")
+	case <-afc.closed:
+	}
+	a.Close(context.Background())
+	stop(context.Background())
+}
+
+// disconnect closes the current connection, if any. afc.mu must be held.
+func (afc *AfcRetryConn) disconnect(ctx context.Context) error {
+	if afc.unwatch == nil {
+		return nil
+	}
+	afc.unwatch()
+	afc.unwatch = nil
+	if afc.assertion != nil {
+		afc.assertion.Release()
+		afc.assertion = nil
+	}
+	return errors.Join(afc.inner.Close(ctx), afc.stop(ctx))
+}
+
+// retryable reports whether err means the connection is gone, rather than
+// the device refusing the request
+func retryable(err error) bool {
+	var status AfcStatus
+	if errors.As(err, &status) {
+		return false
+	}
+	var ne net.Error
+	return errors.Is(err, ErrSessionClosed) || errors.Is(err, io.EOF) ||
+		errors.Is(err, io.ErrUnexpectedEOF) || errors.As(err, &ne)
+}
+
+// retry_error waits for a new connection if err means the current one is
+// gone. Any other error is left to the caller and the connection kept.
 func (afc *AfcRetryConn) retry_error(err error) bool {
-	afc.inner.Close()
-	afc.l.StopSession()
-	if err.Error() != "Shutdown" {
-		log.Println("RETRYAFC: ", err)
+	if !retryable(err) {
+		afc.inner.log.Debug("RETRYAFC", "err", err)
+		return false
+	}
+	// The session may not know yet that the device is gone, do not wait on
+	// StopSession for longer than Give would
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	afc.mu.Lock()
+	afc.disconnect(ctx)
+	afc.mu.Unlock()
+	cancel()
+	select {
+	case <-afc.closed:
 		return false
+	default:
+	}
+	if afc.Sleeping() {
+		afc.inner.log.Debug("RETRYAFC: DEVICE SLEEPING")
 	}
-	log.Println("RETRYAFC: WAITING FOR NEW CONNECTION")
-	afc.l = nil
-	afc.inner = nil
+	afc.inner.log.Debug("RETRYAFC: WAITING FOR NEW CONNECTION")
 	afc.handles = make(map[string]uint64)
-	ret := <-afc.n
+	var ret afcpair
+	select {
+	case ret = <-afc.n:
+	case <-afc.closed:
+		return false
+	}
+	afc.mu.Lock()
 	afc.inner = ret.a
-	afc.l = ret.l
-	log.Println("RETRYAFC: NEW CONNECTION")
+	afc.stop = ret.stop
+	afc.watch()
+	afc.mu.Unlock()
+	afc.inner.log.Debug("RETRYAFC: NEW CONNECTION")
+	afc.inner.l.metrics.Add("imobile_afc_reconnects_total", 1, "device", afc.inner.l.device())
 	return true
 }
 
@@ -85,8 +278,7 @@ type AfcFile struct {
 	rafc  *AfcRetryConn
 	file  string
 	seek  int64
-	last  int64
-	lastT time.Time
+	meter *progressMeter
 }
 
 // Reopen file and seeks to correct position
@@ -117,18 +309,13 @@ func (f *AfcFile) Read(p []byte) (n int, err error) {
 		}
 		read, err := f.rafc.inner.FileRefRead(handle, uint64(len(p)))
 		if err == nil {
-			f.seek += int64(len(read))
-			copy(read, p)
-			v := time.Now()
-			if v.Sub(f.lastT) > time.Second {
-				log.Println("READING : ", f.file, len(p), f.seek-f.last, v.Sub(f.lastT))
-				f.lastT = v
-				f.last = f.seek
-			}
-			if len(read) == 0 {
+			n := copy(p, read)
+			f.seek += int64(n)
+			f.meter.add(n)
+			if n == 0 {
 				return 0, io.EOF
 			}
-			return len(read), nil
+			return n, nil
 		}
 		if !f.rafc.retry_error(err) {
 			return 0, err
@@ -165,7 +352,6 @@ func (f *AfcFile) Seek(offset int64, whence int) (int64, error) {
 				}
 				continue
 			}
-			f.last = f.seek
 			return f.seek, nil
 		}
 		if !f.rafc.retry_error(err) {
@@ -176,8 +362,9 @@ func (f *AfcFile) Seek(offset int64, whence int) (int64, error) {
 
 func (f *AfcFile) Close() error {
 	if handle, ok := f.rafc.handles[f.file]; ok {
+		delete(f.rafc.handles, f.file)
 		err := f.rafc.inner.FileRefClose(handle)
-		if err != nil && err.Error() != "Shutdown" {
+		if err != nil && !errors.Is(err, ErrSessionClosed) {
 			return err
 		}
 	}
@@ -194,21 +381,135 @@ func (afc *AfcRetryConn) OpenFile(file string) (*AfcFile, error) {
 			continue
 		}
 		afc.handles[file] = handle
-		return &AfcFile{afc,
-			file,
-			0,
-			0,
-			time.Now(),
-		}, nil
+		return &AfcFile{rafc: afc, file: file}, nil
 	}
 }
 
+// SetProgress reports the progress of GetFile, DownloadFile, DownloadFiles
+// and PutFile to p. A nil p stops reporting.
+func (afc *AfcRetryConn) SetProgress(p Progress) {
+	afc.progress = p
+}
+
+// afcChunk is the size of each AFC read or write request of a transfer
+const afcChunk = 256 << 10
+
 func (afc *AfcRetryConn) GetFile(file string) ([]byte, error) {
-	f, err := afc.OpenFile(file)
+	var buf bytes.Buffer
+	_, err := afc.DownloadFile(file, &buf)
 	if err != nil {
 		return nil, err
 	}
-	return ioutil.ReadAll(f)
+	return buf.Bytes(), nil
+}
+
+// DownloadFile copies file to w
+func (afc *AfcRetryConn) DownloadFile(file string, w io.Writer) (int64, error) {
+	defer afc.transfer()()
+	total := int64(-1)
+	if afc.progress != nil {
+		if fi, err := afc.GetFileInfo(file); err == nil {
+			total = int64(fi.St_size)
+		}
+	}
+	return afc.download(file, w, newProgressMeter(afc.progress, file, total))
+}
+
+// DownloadFiles copies each of files to the same path below dir, reporting
+// progress for every file and for the whole batch
+func (afc *AfcRetryConn) DownloadFiles(files []string, dir string) error {
+	defer afc.transfer()()
+	sizes := make([]int64, len(files))
+	var batch *progressMeter
+	if afc.progress != nil {
+		var total int64
+		for i, file := range files {
+			fi, err := afc.GetFileInfo(file)
+			if err != nil {
+				return err
+			}
+			sizes[i] = int64(fi.St_size)
+			total += sizes[i]
+		}
+		batch = newBatchMeter(afc.progress, len(files), total)
+	}
+	for i, file := range files {
+		fn := filepath.Join(dir, filepath.FromSlash(file))
+		if err := os.MkdirAll(filepath.Dir(fn), 0755); err != nil {
+			return err
+		}
+		f, err := os.Create(fn)
+		if err != nil {
+			return err
+		}
+		_, err = afc.download(file, f, batch.file(file, sizes[i]))
+		if cerr := f.Close(); err == nil {
+			err = cerr
+		}
+		if err != nil {
+			return err
+		}
+	}
+	batch.finish()
+	return nil
+}
+
+func (afc *AfcRetryConn) download(file string, w io.Writer, m *progressMeter) (int64, error) {
+	f, err := afc.OpenFile(file)
+	if err != nil {
+		return 0, err
+	}
+	f.meter = m
+	// Hide ReaderFrom and WriterTo so every read is one afcChunk request
+	n, err := io.CopyBuffer(struct{ io.Writer }{w}, struct{ io.Reader }{f}, make([]byte, afcChunk))
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		return n, err
+	}
+	m.finish()
+	return n, nil
+}
+
+// PutFile writes data to file, replacing it. After a reconnect the upload
+// starts again.
+func (afc *AfcRetryConn) PutFile(file string, data []byte) error {
+	defer afc.transfer()()
+	m := newProgressMeter(afc.progress, file, int64(len(data)))
+	for {
+		err := afc.putFile(file, data, m)
+		if err == nil {
+			m.finish()
+			return nil
+		}
+		if !afc.retry_error(err) {
+			return err
+		}
+		m.restart()
+	}
+}
+
+func (afc *AfcRetryConn) putFile(file string, data []byte, m *progressMeter) error {
+	handle, err := afc.inner.FileRefOpenMode(file, AFC_FOPEN_WRONLY)
+	if err != nil {
+		return err
+	}
+	for len(data) > 0 {
+		n := len(data)
+		if n > afcChunk {
+			n = afcChunk
+		}
+		if err := afc.inner.FileRefWrite(handle, data[:n]); err != nil {
+			if !retryable(err) {
+				afc.inner.FileRefClose(handle)
+			}
+			return err
+		}
+		m.add(n)
+		data = data[n:]
+	}
+	return afc.inner.FileRefClose(handle)
 }
 
 func (afc *AfcRetryConn) GetFileHash(file string) error {
@@ -221,7 +522,7 @@ func (afc *AfcRetryConn) GetFileHash(file string) error {
 	if err != nil {
 		return err
 	}
-	log.Println("FILE_HASH", res)
+	afc.inner.log.Debug("RETRYAFC: FILE_HASH", "response", res)
 	return nil
 }
 
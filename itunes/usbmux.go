@@ -0,0 +1,315 @@
+package itunes
+
+import "io"
+import "net"
+import "strconv"
+import "sync/atomic"
+import "encoding/binary"
+import "github.com/pkg/errors"
+import "github.com/DHowett/go-plist"
+
+// UsbmuxSocket is the path of the local usbmuxd socket
+var UsbmuxSocket = "/var/run/usbmuxd"
+
+const (
+	usbmuxVersionPlist = 1
+	usbmuxMessagePlist = 8
+)
+
+// UsbmuxError is a non zero Number in a usbmuxd Result
+type UsbmuxError uint64
+
+const (
+	EUSBMUXBADCOMMAND        UsbmuxError = 1
+	EUSBMUXBADDEVICE         UsbmuxError = 2
+	EUSBMUXCONNECTIONREFUSED UsbmuxError = 3
+	EUSBMUXBADVERSION        UsbmuxError = 6
+)
+
+func (e UsbmuxError) Error() string {
+	switch e {
+	case EUSBMUXBADCOMMAND:
+		return "usbmuxd: Bad Command"
+	case EUSBMUXBADDEVICE:
+		return "usbmuxd: Bad Device"
+	case EUSBMUXCONNECTIONREFUSED:
+		return "usbmuxd: Connection Refused"
+	case EUSBMUXBADVERSION:
+		return "usbmuxd: Bad Version"
+	}
+	return "usbmuxd: UNHANDLED"
+}
+
+// UsbmuxDialer connects to a device attached to the local usbmuxd
+type UsbmuxDialer struct {
+	DeviceID int
+}
+
+func (d UsbmuxDialer) DialPort(port int) (net.Conn, error) {
+	c, err := dialUsbmux()
+	if err != nil {
+		return nil, err
+	}
+	s := newUsbmuxRequest("Connect")
+	s.DeviceID = d.DeviceID
+	s.PortNumber = port>>8&0xFF | port&0xFF<<8 // network byte order
+	var res usbmuxResponse
+	err = c.request(s, &res)
+	if err == nil && res.Number != 0 {
+		err = UsbmuxError(res.Number)
+	}
+	if err != nil {
+		c.Close()
+		return nil, errors.Wrap(err, "usbmuxd: Connect")
+	}
+	return c.Conn, nil
+}
+
+func (d UsbmuxDialer) String() string {
+	return "usbmux:" + strconv.Itoa(d.DeviceID)
+}
+
+// usbmuxConn speaks the usbmuxd plist protocol
+type usbmuxConn struct {
+	net.Conn
+	tag uint32
+}
+
+func dialUsbmux() (*usbmuxConn, error) {
+	c, err := net.Dial("unix", UsbmuxSocket)
+	if err != nil {
+		return nil, errors.Wrap(err, "Unable to Connect to usbmuxd")
+	}
+	return &usbmuxConn{Conn: c}, nil
+}
+
+// request sends a plist message and reads the reply into recv
+func (c *usbmuxConn) request(send interface{}, recv interface{}) error {
+	tag := atomic.AddUint32(&c.tag, 1)
+	if err := c.send(send, tag); err != nil {
+		return err
+	}
+	_, err := c.recv(recv)
+	return err
+}
+
+func (c *usbmuxConn) send(send interface{}, tag uint32) error {
+	payload, err := plist.Marshal(send, plist.XMLFormat)
+	if err != nil {
+		return errors.Wrap(err, "MARSHAL")
+	}
+	header := make([]byte, 16)
+	binary.LittleEndian.PutUint32(header[0:], uint32(16+len(payload)))
+	binary.LittleEndian.PutUint32(header[4:], usbmuxVersionPlist)
+	binary.LittleEndian.PutUint32(header[8:], usbmuxMessagePlist)
+	binary.LittleEndian.PutUint32(header[12:], tag)
+	if _, err := c.Write(append(header, payload...)); err != nil {
+		return errors.Wrap(err, "WRITE")
+	}
+	return nil
+}
+
+// recv reads one plist message into recv and returns its tag
+func (c *usbmuxConn) recv(recv interface{}) (uint32, error) {
+	header := make([]byte, 16)
+	if _, err := io.ReadFull(c, header); err != nil {
+		return 0, errors.Wrap(err, "READ")
+	}
+	length := binary.LittleEndian.Uint32(header[0:])
+	if length < 16 || binary.LittleEndian.Uint32(header[8:]) != usbmuxMessagePlist {
+		return 0, EUNEXPECTEDRESPONSE
+	}
+	payload := make([]byte, length-16)
+	if _, err := io.ReadFull(c, payload); err != nil {
+		return 0, errors.Wrap(err, "READ")
+	}
+	if _, err := plist.Unmarshal(payload, recv); err != nil {
+		return 0, errors.Wrap(err, "UNMARSHAL")
+	}
+	return binary.LittleEndian.Uint32(header[12:]), nil
+}
+
+type usbmuxRequest struct {
+	MessageType         string
+	ClientVersionString string
+	ProgName            string
+	LibUSBMuxVersion    int    `plist:"kLibUSBMuxVersion"`
+	PairRecordID        string `plist:",omitempty"`
+	PairRecordData      []byte `plist:",omitempty"`
+	DeviceID            int    `plist:",omitempty"`
+	PortNumber          int    `plist:",omitempty"`
+}
+
+type usbmuxResponse struct {
+	MessageType    string
+	Number         uint64
+	DeviceID       int
+	Properties     UsbmuxDevice
+	DeviceList     []usbmuxResponse
+	PairRecordData []byte
+	BUID           string
+}
+
+// UsbmuxDevice describes a device known to usbmuxd. SerialNumber is the UDID.
+type UsbmuxDevice struct {
+	DeviceID        int
+	SerialNumber    string
+	ConnectionType  string
+	ConnectionSpeed int
+	ProductID       int
+	LocationID      int
+}
+
+// Dialer returns a DeviceDialer for d, for use with WithDialer
+func (d UsbmuxDevice) Dialer() DeviceDialer {
+	return UsbmuxDialer{d.DeviceID}
+}
+
+// UsbmuxEvent is sent by UsbmuxListen when a device is attached or detached.
+// Only DeviceID is set for detached devices.
+type UsbmuxEvent struct {
+	Attached bool
+	Device   UsbmuxDevice
+}
+
+func newUsbmuxRequest(MessageType string) usbmuxRequest {
+	return usbmuxRequest{
+		MessageType:         MessageType,
+		ClientVersionString: "imobile",
+		ProgName:            "imobile",
+		LibUSBMuxVersion:    3,
+	}
+}
+
+// usbmuxDo sends a single request to usbmuxd on a new connection
+func usbmuxDo(s usbmuxRequest) (usbmuxResponse, error) {
+	var res usbmuxResponse
+	c, err := dialUsbmux()
+	if err != nil {
+		return res, err
+	}
+	defer c.Close()
+	err = c.request(s, &res)
+	if err != nil {
+		return res, errors.Wrap(err, "usbmuxd: "+s.MessageType)
+	}
+	if res.MessageType == "Result" && res.Number != 0 {
+		return res, errors.Wrap(UsbmuxError(res.Number), "usbmuxd: "+s.MessageType)
+	}
+	return res, nil
+}
+
+// UsbmuxListDevices returns the devices currently attached to usbmuxd
+func UsbmuxListDevices() ([]UsbmuxDevice, error) {
+	res, err := usbmuxDo(newUsbmuxRequest("ListDevices"))
+	if err != nil {
+		return nil, err
+	}
+	var ret []UsbmuxDevice
+	for _, d := range res.DeviceList {
+		d.Properties.DeviceID = d.DeviceID
+		ret = append(ret, d.Properties)
+	}
+	return ret, nil
+}
+
+// UsbmuxListen reports attach and detach events until stop is closed or the
+// connection to usbmuxd fails, then closes the returned channel. Devices
+// already attached are reported first.
+func UsbmuxListen(stop <-chan struct{}) (<-chan UsbmuxEvent, error) {
+	c, err := dialUsbmux()
+	if err != nil {
+		return nil, err
+	}
+	var res usbmuxResponse
+	err = c.request(newUsbmuxRequest("Listen"), &res)
+	if err == nil && res.Number != 0 {
+		err = UsbmuxError(res.Number)
+	}
+	if err != nil {
+		c.Close()
+		return nil, errors.Wrap(err, "usbmuxd: Listen")
+	}
+
+	events := make(chan UsbmuxEvent)
+	done := make(chan struct{})
+	go func() {
+		select {
+		case <-stop:
+		case <-done:
+		}
+		c.Close()
+	}()
+	go func() {
+		defer close(events)
+		defer close(done)
+		for {
+			var res usbmuxResponse
+			if _, err := c.recv(&res); err != nil {
+				return
+			}
+			var e UsbmuxEvent
+			switch res.MessageType {
+			case "Attached":
+				e = UsbmuxEvent{true, res.Properties}
+			case "Detached":
+				e = UsbmuxEvent{false, UsbmuxDevice{}}
+			default:
+				continue
+			}
+			e.Device.DeviceID = res.DeviceID
+			select {
+			case events <- e:
+			case <-stop:
+				return
+			}
+		}
+	}()
+	return events, nil
+}
+
+// UsbmuxReadPairRecord reads the pair record usbmuxd holds for UDID
+func UsbmuxReadPairRecord(UDID string) (PairRecord, error) {
+	s := newUsbmuxRequest("ReadPairRecord")
+	s.PairRecordID = UDID
+	res, err := usbmuxDo(s)
+	if err != nil {
+		return PairRecord{}, err
+	}
+	if len(res.PairRecordData) == 0 {
+		return PairRecord{}, ENOPAIRRECORD
+	}
+	return UnmarshalPairRecord(res.PairRecordData)
+}
+
+// UsbmuxSavePairRecord stores pair in usbmuxd for UDID. DeviceID lets
+// usbmuxd announce the device as paired and may be zero.
+func UsbmuxSavePairRecord(UDID string, DeviceID int, pair PairRecord) error {
+	buf, err := MarshalPairRecord(pair, plist.XMLFormat)
+	if err != nil {
+		return err
+	}
+	s := newUsbmuxRequest("SavePairRecord")
+	s.PairRecordID = UDID
+	s.PairRecordData = buf
+	s.DeviceID = DeviceID
+	_, err = usbmuxDo(s)
+	return err
+}
+
+// UsbmuxDeletePairRecord removes the pair record usbmuxd holds for UDID
+func UsbmuxDeletePairRecord(UDID string) error {
+	s := newUsbmuxRequest("DeletePairRecord")
+	s.PairRecordID = UDID
+	_, err := usbmuxDo(s)
+	return err
+}
+
+// UsbmuxReadBUID returns the SystemBUID of this host
+func UsbmuxReadBUID() (string, error) {
+	res, err := usbmuxDo(newUsbmuxRequest("ReadBUID"))
+	if err != nil {
+		return "", err
+	}
+	return res.BUID, nil
+}
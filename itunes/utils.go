@@ -5,26 +5,29 @@ import "net"
 import "crypto/tls"
 import "crypto/x509"
 import "io"
+import "bytes"
 import "github.com/DHowett/go-plist"
 import "encoding/binary"
 
-func tls_connect(c net.Conn, cert tls.Certificate) (net.Conn, error) {
+func tls_connect(c net.Conn, cert tls.Certificate, devcert []byte, keylog io.Writer) (net.Conn, error) {
+	pinned, err := parseCertificate(devcert)
+	if err != nil {
+		return nil, errors.Wrap(EDEVICECERTIFICATEMISMATCH, "Invalid DeviceCertificate in PairRecord")
+	}
 	tc := tls.Client(c, &tls.Config{
 		InsecureSkipVerify: true,
 		Certificates:       []tls.Certificate{cert},
+		KeyLogWriter:       keylog,
 		VerifyPeerCertificate: func(rawCerts [][]byte, verifiedChains [][]*x509.Certificate) error {
-			if len(rawCerts) != 1 {
-				return io.EOF
+			if len(rawCerts) != 1 || !bytes.Equal(rawCerts[0], pinned.Raw) {
+				return EDEVICECERTIFICATEMISMATCH
 			}
-			//				if bytes.Compare(rawCerts[0], devcert) != 0 {
-			//					log.Println("UNMATCHED DEVICE CERTIFICATE")
-			//				}
 			return nil
 		},
 	})
-	err := tc.Handshake()
+	err = tc.Handshake()
 	if err != nil {
-		errors.Wrap(err, "Unable to Perform TLS Handshake")
+		return nil, errors.Wrap(err, "Unable to Perform TLS Handshake")
 	}
 	return tc, nil
 }
@@ -0,0 +1,156 @@
+package itunes
+
+import "io"
+import "encoding/json"
+import "github.com/pkg/errors"
+
+// Lockdown value domains. DomainGlobal is the unnamed domain holding
+// DeviceName, ProductVersion, UniqueDeviceID etc.
+const (
+	DomainGlobal                = ""
+	DomainDiskUsage             = "com.apple.disk_usage"
+	DomainDiskUsageFactory      = "com.apple.disk_usage.factory"
+	DomainBattery               = "com.apple.mobile.battery"
+	DomainInternational         = "com.apple.international"
+	DomainWirelessLockdown      = "com.apple.mobile.wireless_lockdown"
+	DomainDataSync              = "com.apple.mobile.data_sync"
+	DomainTetheredSync          = "com.apple.mobile.tethered_sync"
+	DomainBackup                = "com.apple.mobile.backup"
+	DomainITunes                = "com.apple.mobile.iTunes"
+	DomainITunesStore           = "com.apple.mobile.iTunes.store"
+	DomainRestriction           = "com.apple.mobile.restriction"
+	DomainUserPreferences       = "com.apple.mobile.user_preferences"
+	DomainSoftwareBehavior      = "com.apple.mobile.software_behavior"
+	DomainSyncDataClass         = "com.apple.mobile.sync_data_class"
+	DomainMobileAppUsage        = "com.apple.mobile.mobile_application_usage"
+	DomainLockdownCache         = "com.apple.mobile.lockdown_cache"
+	DomainChaperone             = "com.apple.mobile.chaperone"
+	DomainThirdPartyTermination = "com.apple.mobile.third_party_termination"
+	DomainPurpleBuddy           = "com.apple.PurpleBuddy"
+	DomainFairplay              = "com.apple.fairplay"
+	DomainDeveloper             = "com.apple.xcode.developerdomain"
+)
+
+// KnownDomains is the list of domains read by DumpDomains
+var KnownDomains = []string{
+	DomainGlobal,
+	DomainDiskUsage,
+	DomainDiskUsageFactory,
+	DomainBattery,
+	DomainInternational,
+	DomainWirelessLockdown,
+	DomainDataSync,
+	DomainTetheredSync,
+	DomainBackup,
+	DomainITunes,
+	DomainITunesStore,
+	DomainRestriction,
+	DomainUserPreferences,
+	DomainSoftwareBehavior,
+	DomainSyncDataClass,
+	DomainMobileAppUsage,
+	DomainLockdownCache,
+	DomainChaperone,
+	DomainThirdPartyTermination,
+	DomainPurpleBuddy,
+	DomainFairplay,
+	DomainDeveloper,
+}
+
+// GetDomain returns every value in Domain
+func (l *Lockdown) GetDomain(Domain string) (map[string]interface{}, error) {
+	var ret map[string]interface{}
+	err := l.GetDomainValue(Domain, "", &ret)
+	if err != nil {
+		return nil, err
+	}
+	return ret, nil
+}
+
+// GetAllDomains reads every domain in KnownDomains. Domains the device refuses
+// to return are left out, the global domain is stored under "".
+func (l *Lockdown) GetAllDomains() (map[string]map[string]interface{}, error) {
+	ret := make(map[string]map[string]interface{})
+	for _, d := range KnownDomains {
+		v, err := l.GetDomain(d)
+		if err != nil {
+			if isLockdownError(err) {
+				continue
+			}
+			return nil, err
+		}
+		ret[d] = v
+	}
+	return ret, nil
+}
+
+// DumpDomains writes every domain in KnownDomains to w as JSON
+func (l *Lockdown) DumpDomains(w io.Writer) error {
+	v, err := l.GetAllDomains()
+	if err != nil {
+		return err
+	}
+	e := json.NewEncoder(w)
+	e.SetIndent("", "\t")
+	return errors.Wrap(e.Encode(v), "DumpDomains: Unable to Encode")
+}
+
+// SetValue stores Value under Key in Domain
+func (l *Lockdown) SetValue(Domain string, Key string, Value interface{}) error {
+	if l.IsGracefullyShuttingdown() {
+		return EGRACEFULSHUTDOWN
+	}
+	var res lockdownValueResponse
+	s := lockdownSetValueRequest{"2", "SetValue", Domain, Key, Value}
+	err := l.request(s, &res)
+	if err != nil {
+		return errors.Wrap(err, "SetValue: Unable to Set Value")
+	}
+	return errors.Wrap(lockdownError(res.Error), "SetValue: "+Domain+" "+Key)
+}
+
+// RemoveValue deletes Key from Domain
+func (l *Lockdown) RemoveValue(Domain string, Key string) error {
+	if l.IsGracefullyShuttingdown() {
+		return EGRACEFULSHUTDOWN
+	}
+	var res lockdownValueResponse
+	s := lockdownRemoveValueRequest{"2", "RemoveValue", Domain, Key}
+	err := l.request(s, &res)
+	if err != nil {
+		return errors.Wrap(err, "RemoveValue: Unable to Remove Value")
+	}
+	return errors.Wrap(lockdownError(res.Error), "RemoveValue: "+Domain+" "+Key)
+}
+
+// SetDeviceName renames the device
+func (l *Lockdown) SetDeviceName(name string) error {
+	return l.SetValue(DomainGlobal, "DeviceName", name)
+}
+
+// SetWifiConnections enables or disables lockdown connections over Wi-Fi
+func (l *Lockdown) SetWifiConnections(enable bool) error {
+	return l.SetValue(DomainWirelessLockdown, "EnableWifiConnections", enable)
+}
+
+// SetLanguage sets the device language, e.g. "en"
+func (l *Lockdown) SetLanguage(language string) error {
+	return l.SetValue(DomainInternational, "Language", language)
+}
+
+// SetLocale sets the device locale, e.g. "en_GB"
+func (l *Lockdown) SetLocale(locale string) error {
+	return l.SetValue(DomainInternational, "Locale", locale)
+}
+
+// isLockdownError reports whether err was returned by lockdownd itself
+// rather than by the connection
+func isLockdownError(err error) bool {
+	switch e := errors.Cause(err).(type) {
+	case LockdownError:
+		return true
+	case iTunesError:
+		return e >= EINVALIDHOSTID && e <= EESCROWLOCKED
+	}
+	return false
+}